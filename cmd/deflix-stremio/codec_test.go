@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestCodecs(t *testing.T) {
+	exp := imdb2torrent.CacheItem{
+		Results: []imdb2torrent.Result{
+			{
+				InfoHash:  "123",
+				MagnetURL: "magnet:?xt=urn:btih:123",
+				Title:     "foo",
+				Quality:   "720p",
+			},
+		},
+		Created: time.Now(),
+	}
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			b, err := encode(c, exp)
+			require.NoError(t, err)
+			// Decoding must work without knowing the codec
+			var actual imdb2torrent.CacheItem
+			err = decode(b, &actual)
+			require.NoError(t, err)
+			// Time.Equal ignores the location and monotonic clock, which don't survive all codecs
+			require.True(t, cmp.Equal(exp, actual))
+		})
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	exp := cacheItem{Value: "foo"}
+
+	// Values from before the format version was written
+	var actual cacheItem
+	b, err := toGob(exp)
+	require.NoError(t, err)
+	require.NoError(t, decode(b, &actual))
+	require.True(t, cmp.Equal(exp, actual))
+	b, err = msgpackCodec{}.marshal(exp)
+	require.NoError(t, err)
+	actual = cacheItem{}
+	require.NoError(t, decode(append([]byte{codecIDmsgpack}, b...), &actual))
+	require.True(t, cmp.Equal(exp, actual))
+
+	// Values with another version
+	b, err = encode(msgpackCodec{}, exp)
+	require.NoError(t, err)
+	require.Equal(t, []byte{formatVersionMarker, formatVersion, codecIDmsgpack}, b[:3])
+	b[1] = formatVersion + 1
+	require.Equal(t, errFormatVersion, decode(b, &actual))
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	var results []imdb2torrent.Result
+	for i := 0; i < 20; i++ {
+		results = append(results, imdb2torrent.Result{
+			InfoHash:  "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1" + strconv.Itoa(i%10),
+			MagnetURL: bigBuckBunnyMagnet,
+			Title:     "Big Buck Bunny (2008) [1080p] [YTS.MX]",
+			Quality:   "1080p (web, 10bit)",
+		})
+	}
+	item := imdb2torrent.CacheItem{
+		Results: results,
+		Created: time.Now(),
+	}
+	for name, c := range codecs {
+		b.Run(name+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encode(c, item); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		encoded, err := encode(c, item)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(encoded)), "bytes/value")
+			for i := 0; i < b.N; i++ {
+				var target imdb2torrent.CacheItem
+				if err := decode(encoded, &target); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
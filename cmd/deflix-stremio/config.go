@@ -2,10 +2,12 @@ package main
 
 import (
 	"flag"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,8 +21,33 @@ type config struct {
 	MaxAgeTorrents       time.Duration `json:"maxAgeTorrents"`
 	CachePath            string        `json:"cachePath"`
 	CacheAgeXD           time.Duration `json:"cacheAgeXD"`
+	CacheAgeStreams      time.Duration `json:"cacheAgeStreams"`
+	CacheAgeUnavailXD    time.Duration `json:"cacheAgeUnavailXD"`
+	CacheAgeTokens       time.Duration `json:"cacheAgeTokens"`
+	MaxCandidatesXD      int           `json:"maxCandidatesXD"`
+	BatchSizeXD          int           `json:"batchSizeXD"`
+	BatchWorkersXD       int           `json:"batchWorkersXD"`
+	WarmIntervalXD       time.Duration `json:"warmIntervalXD"`
+	WarmMaxXD            int           `json:"warmMaxXD"`
+	WarmTokenRD          string        `json:"warmTokenRD"`
+	WarmKeyAD            string        `json:"warmKeyAD"`
+	WarmKeyPM            string        `json:"warmKeyPM"`
+	RetriesXD            int           `json:"retriesXD"`
+	RetryBackoffXD       time.Duration `json:"retryBackoffXD"`
+	RetryMaxElapsedXD    time.Duration `json:"retryMaxElapsedXD"`
 	RedisAddr            string        `json:"redisAddr"`
 	RedisCreds           string        `json:"redisCreds"`
+	RedisCompressMin     int           `json:"redisCompressMin"`
+	MemcachedAddrs       string        `json:"memcachedAddrs"`
+	LocalCacheEntries    int           `json:"localCacheEntries"`
+	LocalCacheAge        time.Duration `json:"localCacheAge"`
+	CachesInDB           bool          `json:"cachesInDB"`
+	CacheMaxEntries      int           `json:"cacheMaxEntries"`
+	CacheJanitor         time.Duration `json:"cacheJanitor"`
+	CacheJitter          float64       `json:"cacheJitter"`
+	CacheSnapshot        string        `json:"cacheSnapshot"`
+	FlushCaches          bool          `json:"flushCaches"`
+	CacheCodec           string        `json:"cacheCodec"`
 	BaseURLyts           string        `json:"baseURLyts"`
 	BaseURLtpb           string        `json:"baseURLtpb"`
 	BaseURL1337x         string        `json:"baseURL1337x"`
@@ -48,6 +75,17 @@ type config struct {
 	OAUTH2clientSecretPM string        `json:"oauth2clientSecretPM"`
 	OAUTH2encryptionKey  string        `json:"oauth2encryptionKey"`
 	ForwardOriginIP      bool          `json:"forwardOriginIP"`
+	Metrics              bool          `json:"metrics"`
+	EventWebhookURL      string        `json:"eventWebhookURL"`
+	NATSurl              string        `json:"natsURL"`
+	NATSsubject          string        `json:"natsSubject"`
+	KafkaBrokers         []string      `json:"kafkaBrokers"`
+	KafkaTopic           string        `json:"kafkaTopic"`
+	ReadOnly             bool          `json:"readOnly"`
+	StreamTitle          string        `json:"streamTitle"`
+	MaintenanceCooldown  time.Duration `json:"maintenanceCooldown"`
+	LogSampleRate        float64       `json:"logSampleRate"`
+	ValidateTokenLimit   int           `json:"validateTokenLimit"`
 	EnvPrefix            string        `json:"envPrefix"`
 }
 
@@ -63,8 +101,33 @@ func parseConfig(logger *zap.Logger) config {
 		maxAgeTorrents       = flag.Duration("maxAgeTorrents", 7*24*time.Hour, "Max age of cache entries for torrents found per IMDb ID. The format must be acceptable by Go's 'time.ParseDuration()', for example \"24h\". Default is 7 days.")
 		cachePath            = flag.String("cachePath", "", `Path for loading persisted caches on startup and persisting the current cache in regular intervals. An empty value will lead to 'os.UserCacheDir()+"/deflix-stremio/cache"'.`)
 		cacheAgeXD           = flag.Duration("cacheAgeXD", 24*time.Hour, "Max age of cache entries for instant availability responses from RealDebrid, AllDebrid and Premiumize. The format must be acceptable by Go's 'time.ParseDuration()', for example \"24h\".")
-		redisAddr            = flag.String("redisAddr", "", `Redis host and port, for example "localhost:6379". It's used for the redirect and stream cache. Keep empty to use in-memory go-cache.`)
+		cacheAgeStreams      = flag.Duration("cacheAgeStreams", 10*24*time.Hour, "Max age of cache entries for stream URLs from RealDebrid, AllDebrid and Premiumize. A long max age allows users to resume a stream days later with the same URL. Cached URLs older than a minute are checked before they're used, and resolved again if they're gone. The format must be acceptable by Go's 'time.ParseDuration()', for example \"24h\". Default is 10 days.")
+		cacheAgeUnavailXD    = flag.Duration("cacheAgeUnavailXD", 10*time.Minute, "Max age of cache entries for torrents that RealDebrid, AllDebrid or Premiumize reported as not instantly available. Those torrents aren't checked again during this time. 0 disables this cache. The format must be acceptable by Go's 'time.ParseDuration()', for example \"10m\".")
+		cacheAgeTokens       = flag.Duration("cacheAgeTokens", 24*time.Hour, "Max age of cache entries for valid API keys and tokens of RealDebrid, AllDebrid and Premiumize users. Can't be longer than 24h, because the debrid clients check tokens again after that anyway. The format must be acceptable by Go's 'time.ParseDuration()', for example \"24h\".")
+		maxCandidatesXD      = flag.Int("maxCandidatesXD", 40, "Max number of torrents per stream request whose instant availability is checked on RealDebrid, AllDebrid and Premiumize, not counting the ones that are cached as available. The remaining ones are checked in the background, so they're cached for the next request. Torrents are picked alternating between the qualities. 0 means no limit.")
+		batchSizeXD          = flag.Int("batchSizeXD", 0, "Max number of torrents per instant availability request to RealDebrid, AllDebrid and Premiumize. Larger lists are split into multiple requests. 0 means the debrid service's own limit is used (100 for RealDebrid, no limit for AllDebrid and Premiumize).")
+		batchWorkersXD       = flag.Int("batchWorkersXD", 4, "Max number of concurrent instant availability requests per stream request, when the torrents are split into multiple requests. Must be at least 1.")
+		warmIntervalXD       = flag.Duration("warmIntervalXD", 0, "Interval in which the instant availability of frequently available torrents is checked again on RealDebrid, AllDebrid and Premiumize when their cache entries expired, so that stream requests for popular movies and TV shows don't have to wait for the debrid service. Only done for the debrid services with a configured API key or token (see warmTokenRD, warmKeyAD, warmKeyPM). 0 disables this. The format must be acceptable by Go's 'time.ParseDuration()', for example \"10m\".")
+		warmMaxXD            = flag.Int("warmMaxXD", 100, "Max number of torrents per debrid service that are checked in each interval of warmIntervalXD")
+		warmTokenRD          = flag.String("warmTokenRD", "", "RealDebrid API token of a service account for the availability checks of warmIntervalXD. Instant availability is the same for all users, but the API requires authentication.")
+		warmKeyAD            = flag.String("warmKeyAD", "", "AllDebrid API key of a service account for the availability checks of warmIntervalXD")
+		warmKeyPM            = flag.String("warmKeyPM", "", "Premiumize API key of a service account for the availability checks of warmIntervalXD")
+		retriesXD            = flag.Int("retriesXD", 0, "Max number of retries of API key and token validations at the debrid services that failed with a transient error, like a connection error, \"502 Bad Gateway\" or \"429 Too Many Requests\". 0 disables retries.")
+		retryBackoffXD       = flag.Duration("retryBackoffXD", 500*time.Millisecond, "Max random wait before the first retry (see retriesXD). It's doubled for each further retry.")
+		retryMaxElapsedXD    = flag.Duration("retryMaxElapsedXD", 3*time.Second, "Max duration from the first attempt of a request to a debrid service until the start of its last retry (see retriesXD). No further retry is started when the wait before it would exceed this. 0 means no limit.")
+		redisAddr            = flag.String("redisAddr", "", `Redis host and port, for example "localhost:6379". It's used for the redirect, stream, availability and token caches, so that multiple instances behind a load balancer share them. Keep empty to use in-memory go-cache.`)
 		redisCreds           = flag.String("redisCreds", "", `Credentials for Redis. Password for Redis version 5 and older, username and password for Redis version 6 and newer. Use the colon character (":") for separating username and password. This implies you can't use a colon in the password when using Redis version 5 or older.`)
+		redisCompressMin     = flag.Int("redisCompressMin", 1024, "Min size in bytes of an encoded redirect or stream cache value to compress it with zstd before storing it in Redis. Lists of torrents in the redirect cache often are several KB. 0 disables compression. Values stored in Redis with a previous setting can still be read.")
+		memcachedAddrs       = flag.String("memcachedAddrs", "", `memcached hosts and ports, separated by comma, for example "cache1:11211,cache2:11211". It's used for the availability and token caches. Keys are distributed via consistent hashing. Unreachable servers lead to cache misses. Ignored when redisAddr is set.`)
+		localCacheEntries    = flag.Int("localCacheEntries", 0, "Max number of entries per in-memory cache in front of the availability and token caches in Redis or memcached. It saves round trips for frequently requested entries. 0 disables the local caches.")
+		localCacheAge        = flag.Duration("localCacheAge", time.Minute, "Max age of entries in the in-memory caches in front of Redis or memcached (see localCacheEntries). Entries of other instances can take this long to replace local ones.")
+		cachesInDB           = flag.Bool("cachesInDB", false, "Store the availability and token caches in the persistent DB at storagePath instead of in-memory go-cache, so that they survive restarts and don't depend on the regular persistence to cachePath. Ignored when redisAddr or memcachedAddrs is set.")
+		cacheMaxEntries      = flag.Int("cacheMaxEntries", 0, "Max number of entries per in-memory availability and token cache. When a cache is full, the least recently used entry is evicted. 0 means no limit. Ignored when redisAddr, memcachedAddrs or cachesInDB is set.")
+		cacheJanitor         = flag.Duration("cacheJanitor", 0, "Interval in which expired entries are removed from the in-memory availability and token caches. 0 keeps the defaults: go-cache removes them every 24h (10m for the unavailability cache), the LRU cache (see cacheMaxEntries) only when they're read or evicted.")
+		cacheJitter          = flag.Float64("cacheJitter", 0, "Max fraction of the cache age by which availability, unavailability and token cache entries expire earlier, chosen randomly per entry. For example 0.1 lets entries with a cacheAgeXD of 24h expire between 21.6h and 24h. This prevents many entries that were written at the same time from expiring at the same time, which leads to a burst of requests to the debrid services. 0 disables it.")
+		cacheSnapshot        = flag.String("cacheSnapshot", "", "Path of a file that the in-memory availability and token caches are written to on shutdown, and loaded from on startup. Unlike the regular persistence to cachePath it's a single file that's always up to date after a shutdown, so it can easily be moved to the next deployment, for example of containers without volumes. Empty disables it.")
+		flushCaches          = flag.Bool("flushCaches", false, "Remove all entries from the availability, unavailability and token caches at startup, for example after a debrid service outage led to wrong entries. Meant for a single start, because with Redis or BadgerDB the entries of all instances are removed. Not supported with memcachedAddrs.")
+		cacheCodec           = flag.String("cacheCodec", "msgpack", `Codec for encoding the values that are stored in Redis and in the persistent DB. Can be "gob", "json" or "msgpack". Values that were stored with a different codec can still be read.`)
 		baseURLyts           = flag.String("baseURLyts", "https://yts.mx", "Base URL for YTS")
 		baseURLtpb           = flag.String("baseURLtpb", "https://apibay.org", "Base URL for the TPB API")
 		baseURL1337x         = flag.String("baseURL1337x", "https://1337x.to", "Base URL for 1337x")
@@ -75,6 +138,7 @@ func parseConfig(logger *zap.Logger) config {
 		baseURLpm            = flag.String("baseURLpm", "https://www.premiumize.me/api", "Base URL for Premiumize")
 		logLevel             = flag.String("logLevel", "debug", `Log level to show only logs with the given and more severe levels. Can be "debug", "info", "warn", "error".`)
 		logEncoding          = flag.String("logEncoding", "console", `Log encoding. Can be "console" or "json", where "json" makes more sense when using centralized logging solutions like ELK, Graylog or Loki.`)
+		logSampleRate        = flag.Float64("logSampleRate", 0, "Fraction of requests for which the request and response size, duration and the timings of the handling stages are logged with INFO level, for example 0.01 for 1%. 0 disables it.")
 		logFoundTorrents     = flag.Bool("logFoundTorrents", false, "Set to true to log each single torrent that was found by one of the torrent site clients (with DEBUG level)")
 		rootURL              = flag.String("rootURL", "https://www.deflix.tv", "Redirect target for the root")
 		extraHeadersXD       = flag.String("extraHeadersXD", "", `Additional HTTP request headers to set for requests to RealDebrid, AllDebrid and Premiumize, in a format like "X-Foo: bar", separated by newline characters ("\n")`)
@@ -92,6 +156,16 @@ func parseConfig(logger *zap.Logger) config {
 		oauth2clientSecretPM = flag.String("oauth2clientSecretPM", "", "Client secret for deflix-stremio on Premiumize")
 		oauth2encryptionKey  = flag.String("oauth2encryptionKey", "", "OAuth2 data encryption key")
 		forwardOriginIP      = flag.Bool("forwardOriginIP", false, `Forward the user's original IP address to RealDebrid and Premiumize. The first "X-Forwarded-For" entry will be used.`)
+		metrics              = flag.Bool("metrics", false, `Collect and expose Prometheus metrics at "/metrics", including counters for events like stream resolutions and stream cache hits. You might want to protect the route in your reverse proxy.`)
+		eventWebhookURL      = flag.String("eventWebhookURL", "", "URL to send events like stream resolutions and debrid service errors to, as JSON in the body of a POST request. Won't be used if empty.")
+		natsURL              = flag.String("natsURL", "", `URL of the NATS server to publish events to, for example "nats://localhost:4222". Multiple servers can be separated by comma. Won't be used if empty.`)
+		natsSubject          = flag.String("natsSubject", "deflix.events", "NATS subject to publish events to")
+		kafkaBrokers         = flag.String("kafkaBrokers", "", `Kafka broker addresses to produce events to, for example "localhost:9092". Multiple brokers can be separated by comma. Won't be used if empty.`)
+		kafkaTopic           = flag.String("kafkaTopic", "deflix-events", "Kafka topic to produce events to")
+		maintenanceCooldown  = flag.Duration("maintenanceCooldown", 5*time.Minute, `Duration for which no torrents are converted into stream URLs after RealDebrid, AllDebrid or Premiumize responded with "503 Service Unavailable", which they do during maintenance. Users get an according error instead, and stream lists only contain torrents that are cached as available. Tokens/keys aren't validated during this time. The format must be acceptable by Go's 'time.ParseDuration()', for example "10m". 0 disables it.`)
+		streamTitle          = flag.String("streamTitle", "{{.Quality}}", `Go template for the title of each stream in Stremio. Available fields: ".Quality" (like "1080p 10bit"), ".Provider" (like "RealDebrid"), ".Title" (title of the first torrent), ".Torrents" (number of torrents for the stream). For example "{{.Quality}} | {{.Provider}}".`)
+		validateTokenLimit   = flag.Int("validateTokenLimit", 10, "Max number of requests per minute and client IP address to the endpoint that the configure webpage uses to check API keys and tokens. Each request leads to a request to RealDebrid, AllDebrid or Premiumize, so this prevents the endpoint from being abused to check keys and tokens in bulk. 0 disables the limit.")
+		readOnly             = flag.Bool("readOnly", false, "Don't add any torrents to the users' RealDebrid, AllDebrid and Premiumize accounts, for example during an incident or when the service's IP is banned. Streams are still listed, but only the ones that were already converted into a stream URL before (and are still in the stream cache) can be played.")
 		envPrefix            = flag.String("envPrefix", "", "Prefix for environment variables")
 	)
 
@@ -159,6 +233,126 @@ func parseConfig(logger *zap.Logger) config {
 	}
 	result.CacheAgeXD = *cacheAgeXD
 
+	if !isArgSet("cacheAgeStreams") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_AGE_STREAMS"); ok {
+			if *cacheAgeStreams, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "CACHE_AGE_STREAMS"))
+			}
+		}
+	}
+	result.CacheAgeStreams = *cacheAgeStreams
+
+	if !isArgSet("cacheAgeUnavailXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_AGE_UNAVAIL_XD"); ok {
+			if *cacheAgeUnavailXD, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "CACHE_AGE_UNAVAIL_XD"))
+			}
+		}
+	}
+	result.CacheAgeUnavailXD = *cacheAgeUnavailXD
+
+	if !isArgSet("cacheAgeTokens") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_AGE_TOKENS"); ok {
+			if *cacheAgeTokens, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "CACHE_AGE_TOKENS"))
+			}
+		}
+	}
+	result.CacheAgeTokens = *cacheAgeTokens
+
+	if !isArgSet("maxCandidatesXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "MAX_CANDIDATES_XD"); ok {
+			if *maxCandidatesXD, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "MAX_CANDIDATES_XD"))
+			}
+		}
+	}
+	result.MaxCandidatesXD = *maxCandidatesXD
+
+	if !isArgSet("batchSizeXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "BATCH_SIZE_XD"); ok {
+			if *batchSizeXD, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "BATCH_SIZE_XD"))
+			}
+		}
+	}
+	result.BatchSizeXD = *batchSizeXD
+
+	if !isArgSet("batchWorkersXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "BATCH_WORKERS_XD"); ok {
+			if *batchWorkersXD, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "BATCH_WORKERS_XD"))
+			}
+		}
+	}
+	result.BatchWorkersXD = *batchWorkersXD
+
+	if !isArgSet("warmIntervalXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "WARM_INTERVAL_XD"); ok {
+			if *warmIntervalXD, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "WARM_INTERVAL_XD"))
+			}
+		}
+	}
+	result.WarmIntervalXD = *warmIntervalXD
+
+	if !isArgSet("warmMaxXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "WARM_MAX_XD"); ok {
+			if *warmMaxXD, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "WARM_MAX_XD"))
+			}
+		}
+	}
+	result.WarmMaxXD = *warmMaxXD
+
+	if !isArgSet("warmTokenRD") {
+		if val, ok := os.LookupEnv(*envPrefix + "WARM_TOKEN_RD"); ok {
+			*warmTokenRD = val
+		}
+	}
+	result.WarmTokenRD = *warmTokenRD
+
+	if !isArgSet("warmKeyAD") {
+		if val, ok := os.LookupEnv(*envPrefix + "WARM_KEY_AD"); ok {
+			*warmKeyAD = val
+		}
+	}
+	result.WarmKeyAD = *warmKeyAD
+
+	if !isArgSet("warmKeyPM") {
+		if val, ok := os.LookupEnv(*envPrefix + "WARM_KEY_PM"); ok {
+			*warmKeyPM = val
+		}
+	}
+	result.WarmKeyPM = *warmKeyPM
+
+	if !isArgSet("retriesXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "RETRIES_XD"); ok {
+			if *retriesXD, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "RETRIES_XD"))
+			}
+		}
+	}
+	result.RetriesXD = *retriesXD
+
+	if !isArgSet("retryBackoffXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "RETRY_BACKOFF_XD"); ok {
+			if *retryBackoffXD, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "RETRY_BACKOFF_XD"))
+			}
+		}
+	}
+	result.RetryBackoffXD = *retryBackoffXD
+
+	if !isArgSet("retryMaxElapsedXD") {
+		if val, ok := os.LookupEnv(*envPrefix + "RETRY_MAX_ELAPSED_XD"); ok {
+			if *retryMaxElapsedXD, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "RETRY_MAX_ELAPSED_XD"))
+			}
+		}
+	}
+	result.RetryMaxElapsedXD = *retryMaxElapsedXD
+
 	if !isArgSet("redisAddr") {
 		if val, ok := os.LookupEnv(*envPrefix + "REDIS_ADDR"); ok {
 			*redisAddr = val
@@ -173,6 +367,99 @@ func parseConfig(logger *zap.Logger) config {
 	}
 	result.RedisCreds = *redisCreds
 
+	if !isArgSet("redisCompressMin") {
+		if val, ok := os.LookupEnv(*envPrefix + "REDIS_COMPRESS_MIN"); ok {
+			if *redisCompressMin, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "REDIS_COMPRESS_MIN"))
+			}
+		}
+	}
+	result.RedisCompressMin = *redisCompressMin
+
+	if !isArgSet("memcachedAddrs") {
+		if val, ok := os.LookupEnv(*envPrefix + "MEMCACHED_ADDRS"); ok {
+			*memcachedAddrs = val
+		}
+	}
+	result.MemcachedAddrs = *memcachedAddrs
+
+	if !isArgSet("localCacheEntries") {
+		if val, ok := os.LookupEnv(*envPrefix + "LOCAL_CACHE_ENTRIES"); ok {
+			if *localCacheEntries, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "LOCAL_CACHE_ENTRIES"))
+			}
+		}
+	}
+	result.LocalCacheEntries = *localCacheEntries
+
+	if !isArgSet("localCacheAge") {
+		if val, ok := os.LookupEnv(*envPrefix + "LOCAL_CACHE_AGE"); ok {
+			if *localCacheAge, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "LOCAL_CACHE_AGE"))
+			}
+		}
+	}
+	result.LocalCacheAge = *localCacheAge
+
+	if !isArgSet("cachesInDB") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHES_IN_DB"); ok {
+			if *cachesInDB, err = strconv.ParseBool(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to bool", zap.Error(err), zap.String("envVar", "CACHES_IN_DB"))
+			}
+		}
+	}
+	result.CachesInDB = *cachesInDB
+
+	if !isArgSet("cacheMaxEntries") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_MAX_ENTRIES"); ok {
+			if *cacheMaxEntries, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "CACHE_MAX_ENTRIES"))
+			}
+		}
+	}
+	result.CacheMaxEntries = *cacheMaxEntries
+
+	if !isArgSet("cacheJanitor") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_JANITOR"); ok {
+			if *cacheJanitor, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "CACHE_JANITOR"))
+			}
+		}
+	}
+	result.CacheJanitor = *cacheJanitor
+
+	if !isArgSet("cacheJitter") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_JITTER"); ok {
+			if *cacheJitter, err = strconv.ParseFloat(val, 64); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to float", zap.Error(err), zap.String("envVar", "CACHE_JITTER"))
+			}
+		}
+	}
+	result.CacheJitter = *cacheJitter
+
+	if !isArgSet("cacheSnapshot") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_SNAPSHOT"); ok {
+			*cacheSnapshot = val
+		}
+	}
+	result.CacheSnapshot = *cacheSnapshot
+
+	if !isArgSet("flushCaches") {
+		if val, ok := os.LookupEnv(*envPrefix + "FLUSH_CACHES"); ok {
+			if *flushCaches, err = strconv.ParseBool(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to bool", zap.Error(err), zap.String("envVar", "FLUSH_CACHES"))
+			}
+		}
+	}
+	result.FlushCaches = *flushCaches
+
+	if !isArgSet("cacheCodec") {
+		if val, ok := os.LookupEnv(*envPrefix + "CACHE_CODEC"); ok {
+			*cacheCodec = val
+		}
+	}
+	result.CacheCodec = *cacheCodec
+
 	if !isArgSet("baseURLyts") {
 		if val, ok := os.LookupEnv(*envPrefix + "BASE_URL_YTS"); ok {
 			*baseURLyts = val
@@ -376,9 +663,121 @@ func parseConfig(logger *zap.Logger) config {
 	}
 	result.ForwardOriginIP = *forwardOriginIP
 
+	if !isArgSet("metrics") {
+		if val, ok := os.LookupEnv(*envPrefix + "METRICS"); ok {
+			if *metrics, err = strconv.ParseBool(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to bool", zap.Error(err), zap.String("envVar", "METRICS"))
+			}
+		}
+	}
+	result.Metrics = *metrics
+
+	if !isArgSet("eventWebhookURL") {
+		if val, ok := os.LookupEnv(*envPrefix + "EVENT_WEBHOOK_URL"); ok {
+			*eventWebhookURL = val
+		}
+	}
+	result.EventWebhookURL = *eventWebhookURL
+
+	if !isArgSet("natsURL") {
+		if val, ok := os.LookupEnv(*envPrefix + "NATS_URL"); ok {
+			*natsURL = val
+		}
+	}
+	result.NATSurl = *natsURL
+
+	if !isArgSet("natsSubject") {
+		if val, ok := os.LookupEnv(*envPrefix + "NATS_SUBJECT"); ok {
+			*natsSubject = val
+		}
+	}
+	result.NATSsubject = *natsSubject
+
+	if !isArgSet("kafkaBrokers") {
+		if val, ok := os.LookupEnv(*envPrefix + "KAFKA_BROKERS"); ok {
+			*kafkaBrokers = val
+		}
+	}
+	if *kafkaBrokers != "" {
+		brokers := strings.Split(*kafkaBrokers, ",")
+		for _, broker := range brokers {
+			broker = strings.TrimSpace(broker)
+			if broker != "" {
+				result.KafkaBrokers = append(result.KafkaBrokers, broker)
+			}
+		}
+	}
+
+	if !isArgSet("kafkaTopic") {
+		if val, ok := os.LookupEnv(*envPrefix + "KAFKA_TOPIC"); ok {
+			*kafkaTopic = val
+		}
+	}
+	result.KafkaTopic = *kafkaTopic
+
+	if !isArgSet("readOnly") {
+		if val, ok := os.LookupEnv(*envPrefix + "READ_ONLY"); ok {
+			if *readOnly, err = strconv.ParseBool(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to bool", zap.Error(err), zap.String("envVar", "READ_ONLY"))
+			}
+		}
+	}
+	result.ReadOnly = *readOnly
+
+	if !isArgSet("streamTitle") {
+		if val, ok := os.LookupEnv(*envPrefix + "STREAM_TITLE"); ok {
+			*streamTitle = val
+		}
+	}
+	result.StreamTitle = *streamTitle
+
+	if !isArgSet("maintenanceCooldown") {
+		if val, ok := os.LookupEnv(*envPrefix + "MAINTENANCE_COOLDOWN"); ok {
+			if *maintenanceCooldown, err = time.ParseDuration(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to time.Duration", zap.Error(err), zap.String("envVar", "MAINTENANCE_COOLDOWN"))
+			}
+		}
+	}
+	result.MaintenanceCooldown = *maintenanceCooldown
+
+	if !isArgSet("logSampleRate") {
+		if val, ok := os.LookupEnv(*envPrefix + "LOG_SAMPLE_RATE"); ok {
+			if *logSampleRate, err = strconv.ParseFloat(val, 64); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to float", zap.Error(err), zap.String("envVar", "LOG_SAMPLE_RATE"))
+			}
+		}
+	}
+	result.LogSampleRate = *logSampleRate
+
+	if !isArgSet("validateTokenLimit") {
+		if val, ok := os.LookupEnv(*envPrefix + "VALIDATE_TOKEN_LIMIT"); ok {
+			if *validateTokenLimit, err = strconv.Atoi(val); err != nil {
+				logger.Fatal("Couldn't convert environment variable from string to int", zap.Error(err), zap.String("envVar", "VALIDATE_TOKEN_LIMIT"))
+			}
+		}
+	}
+	result.ValidateTokenLimit = *validateTokenLimit
+
 	return result
 }
 
+// redacted returns a copy of the config in which the values that can contain credentials are replaced, so that it can be logged.
+func (c config) redacted() config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "REDACTED"
+		}
+	}
+	// Webhook URLs often contain a secret token in the path or query
+	redact(&c.EventWebhookURL)
+	// NATS URLs can contain a user and password or token
+	redact(&c.NATSurl)
+	redact(&c.WarmTokenRD)
+	redact(&c.WarmKeyAD)
+	redact(&c.WarmKeyPM)
+	return c
+}
+
 func (c *config) validate(logger *zap.Logger) {
 	if c.StoragePath == "" {
 		userCacheDir, err := os.UserCacheDir()
@@ -411,6 +810,65 @@ func (c *config) validate(logger *zap.Logger) {
 		logger.Fatal("Using OAuth2 requires setting all OAuth2 config values")
 	}
 
+	if c.CacheAgeTokens <= 0 || c.CacheAgeTokens > 24*time.Hour {
+		logger.Fatal("cacheAgeTokens must be between 0 and 24h", zap.Duration("cacheAgeTokens", c.CacheAgeTokens))
+	}
+
+	if c.BatchWorkersXD < 1 {
+		logger.Fatal("batchWorkersXD must be at least 1", zap.Int("batchWorkersXD", c.BatchWorkersXD))
+	}
+
+	if c.WarmIntervalXD > 0 && c.WarmTokenRD == "" && c.WarmKeyAD == "" && c.WarmKeyPM == "" {
+		logger.Fatal("warmIntervalXD requires at least one of warmTokenRD, warmKeyAD and warmKeyPM")
+	}
+	if c.WarmIntervalXD > 0 && c.WarmIntervalXD >= c.CacheAgeXD {
+		logger.Fatal("warmIntervalXD must be shorter than cacheAgeXD", zap.Duration("warmIntervalXD", c.WarmIntervalXD), zap.Duration("cacheAgeXD", c.CacheAgeXD))
+	}
+
+	if c.RetriesXD < 0 {
+		logger.Fatal("retriesXD must not be negative", zap.Int("retriesXD", c.RetriesXD))
+	}
+	if c.RetriesXD > 0 && c.RetryBackoffXD <= 0 {
+		logger.Fatal("retryBackoffXD must be positive when retriesXD is set", zap.Duration("retryBackoffXD", c.RetryBackoffXD))
+	}
+	if c.RetryMaxElapsedXD < 0 {
+		logger.Fatal("retryMaxElapsedXD must not be negative", zap.Duration("retryMaxElapsedXD", c.RetryMaxElapsedXD))
+	}
+
+	// Parsed here instead of when it's used, because a failure there would end the process with open BadgerDB files
+	if _, err := template.New("streamTitle").Parse(c.StreamTitle); err != nil {
+		logger.Fatal("Couldn't parse stream title template", zap.Error(err), zap.String("streamTitle", c.StreamTitle))
+	}
+
+	// NaN would make every comparison false, so it's checked explicitly
+	if math.IsNaN(c.LogSampleRate) || c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		logger.Fatal("logSampleRate must be between 0 and 1", zap.Float64("logSampleRate", c.LogSampleRate))
+	}
+
+	if c.ValidateTokenLimit < 0 {
+		logger.Fatal("validateTokenLimit must not be negative", zap.Int("validateTokenLimit", c.ValidateTokenLimit))
+	}
+
+	if math.IsNaN(c.CacheJitter) || c.CacheJitter < 0 || c.CacheJitter >= 1 {
+		logger.Fatal("cacheJitter must be at least 0 and less than 1", zap.Float64("cacheJitter", c.CacheJitter))
+	}
+
+	if c.LocalCacheEntries > 0 && c.LocalCacheAge <= 0 {
+		logger.Fatal("localCacheAge must be positive when localCacheEntries is set", zap.Duration("localCacheAge", c.LocalCacheAge))
+	}
+
+	if c.CacheJanitor < 0 {
+		logger.Fatal("cacheJanitor must not be negative", zap.Duration("cacheJanitor", c.CacheJanitor))
+	}
+
+	if c.FlushCaches && c.MemcachedAddrs != "" && c.RedisAddr == "" {
+		logger.Fatal("flushCaches isn't supported with memcachedAddrs")
+	}
+
+	if _, err := parseCodec(c.CacheCodec); err != nil {
+		logger.Fatal(`cacheCodec must be one of "gob", "json" or "msgpack"`, zap.String("cacheCodec", c.CacheCodec))
+	}
+
 	if c.LogEncoding != "console" && c.LogEncoding != "json" {
 		logger.Fatal(`logEncoding must be one of "console" or "json"`, zap.String("logEncoding", c.LogEncoding))
 	}
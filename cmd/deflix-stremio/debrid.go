@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/go-debrid/alldebrid"
+	"github.com/deflix-tv/go-debrid/premiumize"
+	"github.com/deflix-tv/go-debrid/realdebrid"
+)
+
+// debridProvider is the common interface of the RealDebrid, AllDebrid and Premiumize clients,
+// so that the handlers don't need to switch over the debrid services for each call.
+type debridProvider interface {
+	TestToken(ctx context.Context, keyOrToken string) error
+	CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string
+	// remote is ignored by debrid services that don't support remote traffic.
+	GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, remote bool) (string, error)
+	Capabilities() capabilities
+}
+
+// capabilities describes what a debrid service (and its client) supports.
+type capabilities struct {
+	// Whether the debrid service can tell if torrents are cached, so they can be streamed right away
+	InstantAvailability bool
+	// Whether the debrid service supports "remote traffic", which allows sharing an account with friends
+	Remote bool
+	// Whether transcoded streams can be delivered. None of the go-debrid clients support this yet.
+	Transcode bool
+	// Max number of info hashes per instant availability request. 0 means there's no limit.
+	MaxBatchSize int
+}
+
+var _ debridProvider = rdProvider{}
+
+type rdProvider struct {
+	client *realdebrid.Client
+}
+
+func (p rdProvider) TestToken(ctx context.Context, keyOrToken string) error {
+	return p.client.TestToken(ctx, keyOrToken)
+}
+
+func (p rdProvider) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	return p.client.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+}
+
+func (p rdProvider) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, remote bool) (string, error) {
+	return p.client.GetStreamURL(ctx, magnetURL, keyOrToken, remote)
+}
+
+func (p rdProvider) Capabilities() capabilities {
+	return capabilities{
+		InstantAvailability: true,
+		Remote:              true,
+		// The info hashes are part of the URL path of a GET request, so too many lead to a too long URL
+		MaxBatchSize: 100,
+	}
+}
+
+var _ debridProvider = adProvider{}
+
+type adProvider struct {
+	client *alldebrid.Client
+}
+
+func (p adProvider) TestToken(ctx context.Context, keyOrToken string) error {
+	return p.client.TestAPIkey(ctx, keyOrToken)
+}
+
+func (p adProvider) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	return p.client.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+}
+
+func (p adProvider) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _ bool) (string, error) {
+	return p.client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
+
+func (p adProvider) Capabilities() capabilities {
+	return capabilities{
+		InstantAvailability: true,
+	}
+}
+
+var _ debridProvider = pmProvider{}
+
+type pmProvider struct {
+	client *premiumize.Client
+}
+
+func (p pmProvider) TestToken(ctx context.Context, keyOrToken string) error {
+	return p.client.TestAPIkey(ctx, keyOrToken)
+}
+
+func (p pmProvider) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	return p.client.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+}
+
+func (p pmProvider) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _ bool) (string, error) {
+	return p.client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
+
+func (p pmProvider) Capabilities() capabilities {
+	return capabilities{
+		InstantAvailability: true,
+	}
+}
+
+// availability is the result of an availability check.
+type availability struct {
+	// Info hashes of the instantly available torrents
+	available []string
+	// Info hashes of the torrents that the debrid service reported as not instantly available.
+	// Only the ones from requests that are known to have succeeded, see checkInstantAvailability.
+	unavailable []string
+}
+
+// checkInstantAvailability checks the instant availability of the info hashes in batches of at most batchSize info hashes,
+// or the provider's max batch size if it's lower. 0 means no limit. Up to workers batches are checked concurrently.
+// Info hashes that are cached as available and not expired yet aren't part of any batch, because the debrid client wouldn't send a request for them anyway.
+// The debrid clients don't return errors for failed requests, but log them and only return the cached info hashes.
+// So only a batch without cached info hashes and with a non-empty result is known to have succeeded, and only then its other info hashes are reported as unavailable.
+// For an empty result it's unknown whether none of the torrents is available or the request failed.
+// With a nil availabilityCache all info hashes are passed to the debrid client and none are reported as unavailable.
+func checkInstantAvailability(ctx context.Context, provider debridProvider, availabilityCache debrid.Cache, cacheAge time.Duration, keyOrToken string, batchSize, workers int, infoHashes ...string) availability {
+	var result availability
+	uncached := infoHashes
+	if availabilityCache != nil {
+		uncached = nil
+		for _, infoHash := range infoHashes {
+			// Errors are treated as cache misses. The debrid client logs them when it does the same lookup.
+			created, found, err := availabilityCache.Get(infoHash)
+			if err == nil && found && time.Since(created) <= cacheAge {
+				result.available = append(result.available, infoHash)
+			} else {
+				uncached = append(uncached, infoHash)
+			}
+		}
+	}
+	if len(uncached) == 0 {
+		return result
+	}
+
+	if maxBatchSize := provider.Capabilities().MaxBatchSize; maxBatchSize > 0 && (batchSize <= 0 || batchSize > maxBatchSize) {
+		batchSize = maxBatchSize
+	}
+	if batchSize <= 0 {
+		batchSize = len(uncached)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var batches [][]string
+	for start := 0; start < len(uncached); start += batchSize {
+		end := start + batchSize
+		if end > len(uncached) {
+			end = len(uncached)
+		}
+		batches = append(batches, uncached[start:end])
+	}
+	batchResults := make([][]string, len(batches))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			batchResults[i] = provider.CheckInstantAvailability(ctx, keyOrToken, batch...)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	for i, batchResult := range batchResults {
+		result.available = append(result.available, batchResult...)
+		if availabilityCache == nil || len(batchResult) == 0 {
+			continue
+		}
+		// RealDebrid returns upper case info hashes
+		availableSet := make(map[string]struct{}, len(batchResult))
+		for _, infoHash := range batchResult {
+			availableSet[strings.ToUpper(infoHash)] = struct{}{}
+		}
+		for _, infoHash := range batches[i] {
+			if _, ok := availableSet[strings.ToUpper(infoHash)]; !ok {
+				result.unavailable = append(result.unavailable, infoHash)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deflix-tv/go-debrid"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider behaves like the go-debrid clients: Info hashes that are cached as available aren't part of the request,
+// and a failed request (fail) only returns those.
+type fakeProvider struct {
+	caps capabilities
+	// Optional
+	cache    debrid.Cache
+	cacheAge time.Duration
+	// Info hashes of instantly available torrents. nil means all are available.
+	available map[string]bool
+	fail      bool
+	// Info hashes of the sent requests
+	batches [][]string
+	lock    sync.Mutex
+}
+
+func (p *fakeProvider) TestToken(ctx context.Context, keyOrToken string) error {
+	return nil
+}
+
+func (p *fakeProvider) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var result, request []string
+	for _, infoHash := range infoHashes {
+		if p.cache != nil {
+			if created, found, err := p.cache.Get(infoHash); err == nil && found && time.Since(created) <= p.cacheAge {
+				result = append(result, infoHash)
+				continue
+			}
+		}
+		request = append(request, infoHash)
+	}
+	if len(request) == 0 {
+		return result
+	}
+	p.batches = append(p.batches, request)
+	if p.fail {
+		return result
+	}
+	for _, infoHash := range request {
+		if p.available == nil || p.available[infoHash] {
+			result = append(result, infoHash)
+			if p.cache != nil {
+				_ = p.cache.Set(infoHash)
+			}
+		}
+	}
+	return result
+}
+
+func (p *fakeProvider) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, remote bool) (string, error) {
+	return "", nil
+}
+
+func (p *fakeProvider) Capabilities() capabilities {
+	return p.caps
+}
+
+func TestCheckInstantAvailability(t *testing.T) {
+	var infoHashes []string
+	for i := 0; i < 5; i++ {
+		infoHashes = append(infoHashes, strconv.Itoa(i))
+	}
+
+	// No limit
+	p := &fakeProvider{}
+	available := checkInstantAvailability(context.Background(), p, nil, 0, "123", 0, 2, infoHashes...)
+	require.Equal(t, infoHashes, available.available)
+	require.Len(t, p.batches, 1)
+
+	// Provider limit. Batches are checked concurrently, but the result keeps the order.
+	p = &fakeProvider{caps: capabilities{MaxBatchSize: 2}}
+	available = checkInstantAvailability(context.Background(), p, nil, 0, "123", 0, 2, infoHashes...)
+	require.Equal(t, infoHashes, available.available)
+	require.ElementsMatch(t, [][]string{{"0", "1"}, {"2", "3"}, {"4"}}, p.batches)
+
+	// Configured batch size can only lower the provider limit
+	p = &fakeProvider{caps: capabilities{MaxBatchSize: 2}}
+	checkInstantAvailability(context.Background(), p, nil, 0, "123", 3, 2, infoHashes...)
+	require.Len(t, p.batches, 3)
+	p = &fakeProvider{}
+	checkInstantAvailability(context.Background(), p, nil, 0, "123", 3, 2, infoHashes...)
+	require.ElementsMatch(t, [][]string{{"0", "1", "2"}, {"3", "4"}}, p.batches)
+}
+
+func TestCheckInstantAvailabilityUnavailable(t *testing.T) {
+	ctx := context.Background()
+	cache := debrid.NewInMemoryCache()
+	require.NoError(t, cache.Set("A1"))
+
+	// A failed request only returns the cached info hash, which must not make the others look unavailable
+	p := &fakeProvider{cache: cache, cacheAge: time.Minute, fail: true}
+	result := checkInstantAvailability(ctx, p, cache, time.Minute, "123", 0, 1, "A1", "A2", "A3")
+	require.Equal(t, []string{"A1"}, result.available)
+	require.Empty(t, result.unavailable)
+	// The cached info hash isn't part of the request
+	require.Equal(t, [][]string{{"A2", "A3"}}, p.batches)
+
+	// Only batches with a result are known to have succeeded
+	p = &fakeProvider{caps: capabilities{MaxBatchSize: 2}, cache: cache, cacheAge: time.Minute, available: map[string]bool{"A2": true}}
+	result = checkInstantAvailability(ctx, p, cache, time.Minute, "123", 0, 1, "A1", "A2", "A3", "A4", "A5")
+	require.Equal(t, []string{"A1", "A2"}, result.available)
+	require.Equal(t, []string{"A3"}, result.unavailable)
+	require.Equal(t, [][]string{{"A2", "A3"}, {"A4", "A5"}}, p.batches)
+
+	// Without cache nothing is reported as unavailable
+	p = &fakeProvider{available: map[string]bool{"A2": true}}
+	result = checkInstantAvailability(ctx, p, nil, 0, "123", 0, 1, "A1", "A2")
+	require.Equal(t, []string{"A2"}, result.available)
+	require.Empty(t, result.unavailable)
+}
@@ -5,24 +5,36 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
-	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 
+	"github.com/deflix-tv/go-debrid"
 	"github.com/deflix-tv/go-debrid/alldebrid"
 	"github.com/deflix-tv/go-debrid/premiumize"
 	"github.com/deflix-tv/go-debrid/realdebrid"
 	"github.com/deflix-tv/go-stremio"
 	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/events"
 )
 
 const (
+	// Max number of concurrent background availability checks per stream handler
+	maxBackgroundChecks = 10
+	// Max duration of a background availability check, which can consist of several batches
+	backgroundCheckTimeout = 30 * time.Second
+
+	maintenanceMsg     = "The debrid service is under maintenance, so only previously watched streams can be played. Please try again later."
+	rateLimitMsg       = "The debrid service received too many requests. Please try again in a minute."
 	bigBuckBunnyMagnet = `magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=Big+Buck+Bunny&tr=udp%3A%2F%2Fexplodie.org%3A6969&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969&tr=udp%3A%2F%2Ftracker.empire-js.us%3A1337&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337&tr=wss%3A%2F%2Ftracker.btorrent.xyz&tr=wss%3A%2F%2Ftracker.fastcast.nz&tr=wss%3A%2F%2Ftracker.openwebtorrent.com&ws=https%3A%2F%2Fwebtorrent.io%2Ftorrents%2F&xs=https%3A%2F%2Fwebtorrent.io%2Ftorrents%2Fbig-buck-bunny.torrent`
 )
 
@@ -32,7 +44,45 @@ type goCacher interface {
 	Get(string) (interface{}, bool)
 }
 
-func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, redirectCache goCacher, isTVShow bool, logger *zap.Logger) stremio.StreamHandler {
+// createManifestCallback creates a manifest callback that customizes the manifest depending on the user's configuration.
+// The addon name gets the debrid service name as suffix, so users with multiple installations can tell them apart,
+// and the logo is replaced if the user configured a custom logo URL.
+func createManifestCallback(logger *zap.Logger) stremio.ManifestCallback {
+	return func(ctx context.Context, manifest *stremio.Manifest, userDataIface interface{}) int {
+		// Empty when the manifest is requested without user data, for example from the Stremio addon catalog
+		udString, _ := userDataIface.(string)
+		if udString == "" {
+			return fiber.StatusOK
+		}
+		// No need to check if decoding worked, because the token middleware does that already.
+		userData, _ := decodeUserData(udString, logger)
+
+		if userData.RDtoken != "" || userData.RDoauth2 != "" {
+			manifest.Name += " (RealDebrid)"
+		} else if userData.ADkey != "" {
+			manifest.Name += " (AllDebrid)"
+		} else if userData.PMkey != "" || userData.PMoauth2 != "" {
+			manifest.Name += " (Premiumize)"
+		}
+
+		if userData.LogoURL != "" {
+			if logoURL, err := url.Parse(userData.LogoURL); err != nil || (logoURL.Scheme != "https" && logoURL.Scheme != "http") || logoURL.Host == "" {
+				logger.Info("User data contains invalid logo URL, using default logo", zap.String("logoURL", userData.LogoURL))
+			} else {
+				manifest.Logo = logoURL.String()
+			}
+		}
+
+		return fiber.StatusOK
+	}
+}
+
+func createStreamHandler(config config, searchClient *imdb2torrent.Client, providers map[string]debridProvider, availabilityCaches map[string]debrid.Cache, unavailableCache debrid.Cache, warmer *availabilityWarmer, redirectCache goCacher, maintenance *maintenanceTracker, titleTemplate *template.Template, isTVShow bool, logger *zap.Logger) stremio.StreamHandler {
+	// When the availability cache entries of a popular title expire, many concurrent stream requests would check the same info hashes.
+	// Instant availability is the same for all users of a debrid service, so only one of them sends requests and the others wait for its result.
+	availabilityGroup := &singleflight.Group{}
+	// Limits the availability checks of overflow torrents that run in the background, so that a burst of stream requests doesn't lead to a burst of goroutines and debrid requests
+	backgroundChecks := make(chan struct{}, maxBackgroundChecks)
 	return func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
 		var imdbID string
 		var season int
@@ -59,12 +109,16 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 			imdbID = id
 		}
 
+		// Only set for sampled requests
+		timings, _ := ctx.Value("deflix_stageTimings").(*stageTimings)
+
 		var torrents []imdb2torrent.Result
 		if isTVShow {
 			torrents, err = searchClient.FindTVShow(ctx, imdbID, season, episode)
 		} else {
 			torrents, err = searchClient.FindMovie(ctx, imdbID)
 		}
+		timings.track("findTorrents")
 		if err != nil {
 			logger.Warn("Couldn't find magnets", zap.Error(err))
 			return nil, fmt.Errorf("Couldn't find magnets: %w", err)
@@ -79,28 +133,76 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 		userData, _ := decodeUserData(udString, logger)
 
 		// Filter out the ones that are not available
-		var infoHashes []string
-		for _, torrent := range torrents {
-			infoHashes = append(infoHashes, torrent.InfoHash)
+		debridID := userData.debridID()
+		keyOrToken := ctx.Value("deflix_keyOrToken").(string)
+		provider := providers[debridID]
+		checkAvailability := func(ctx context.Context, infoHashes ...string) []string {
+			// Without instant availability info we can only offer all torrents and hope for the best
+			if !provider.Capabilities().InstantAvailability {
+				return infoHashes
+			}
+			if len(infoHashes) == 0 {
+				return nil
+			}
+			// The info hashes are in the same order for the same search results, so concurrent requests for the same title lead to the same key
+			// Note: The first request's context is used, so if that request is canceled, the waiting ones get an incomplete result as well.
+			key := debridID + "-" + strings.Join(infoHashes, ",")
+			res, _, shared := availabilityGroup.Do(key, func() (interface{}, error) {
+				return checkInstantAvailability(ctx, provider, availabilityCaches[debridID], config.CacheAgeXD, keyOrToken, config.BatchSizeXD, config.BatchWorkersXD, infoHashes...), nil
+			})
+			if shared {
+				logger.Debug("Shared availability check with concurrent request", zap.Int("infoHashes", len(infoHashes)))
+			}
+			result := res.(availability)
+			if config.CacheAgeUnavailXD > 0 {
+				markUnavailable(unavailableCache, debridID, result.unavailable)
+			}
+			return result.available
 		}
-		var debridID string
+		candidateTorrents := torrents
+		if config.CacheAgeUnavailXD > 0 {
+			candidateTorrents = withoutUnavailable(torrents, unavailableCache, debridID, config.CacheAgeUnavailXD)
+		}
+		// To keep the number of requests to the debrid service predictable, we only check a limited number of torrents during the request.
+		// The overflow is checked in the background, so the results are in the availability cache for the next request.
 		var availableInfoHashes []string
-		keyOrToken := ctx.Value("deflix_keyOrToken").(string)
-		if userData.RDtoken != "" || userData.RDoauth2 != "" {
-			debridID = "rd"
-			availableInfoHashes = rdClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
-		} else if userData.ADkey != "" {
-			debridID = "ad"
-			availableInfoHashes = adClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+		underMaintenance := maintenance.active(debridID)
+		if underMaintenance {
+			// No requests to the debrid service during maintenance. Torrents that were available before most likely still are,
+			// and they can be played if their stream URL is cached in the redirect handler.
+			logger.Info("Debrid service is under maintenance, only using cached availability")
+			availableInfoHashes = cachedInfoHashes(candidateTorrents, availabilityCaches[debridID], config.CacheAgeXD)
 		} else {
-			debridID = "pm"
-			availableInfoHashes = pmClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+			infoHashes, overflowInfoHashes := selectAvailabilityCandidates(candidateTorrents, availabilityCaches[debridID], config.CacheAgeXD, config.MaxCandidatesXD)
+			if len(overflowInfoHashes) > 0 {
+				logger.Debug("Checking availability of remaining torrents in the background", zap.Int("checkedNow", len(infoHashes)), zap.Int("checkedInBackground", len(overflowInfoHashes)))
+				select {
+				case backgroundChecks <- struct{}{}:
+					go func() {
+						defer func() { <-backgroundChecks }()
+						// The request context is canceled after the response is sent.
+						ctx, cancel := context.WithTimeout(context.Background(), backgroundCheckTimeout)
+						defer cancel()
+						checkAvailability(ctx, overflowInfoHashes...)
+					}()
+				default:
+					// They're checked by a later request
+					logger.Debug("Too many background availability checks, skipping this one", zap.Int("overflow", len(overflowInfoHashes)))
+				}
+			}
+			availableInfoHashes = checkAvailability(ctx, infoHashes...)
 		}
-		if len(availableInfoHashes) == 0 {
+		timings.track("checkAvailability")
+		if len(availableInfoHashes) == 0 && underMaintenance {
+			return []stremio.StreamItem{createMaintenanceStreamItem(config, udString, debridID)}, nil
+		} else if len(availableInfoHashes) == 0 {
 			// TODO: queue for download on the debrid service, or log somewhere for an asynchronous process to go through them and queue them?
 			logger.Info("None of the found torrents are instantly available on the debrid service")
 			return nil, stremio.NotFound
 		}
+		if !underMaintenance {
+			warmer.track(debridID, availableInfoHashes)
+		}
 		// https://github.com/golang/go/wiki/SliceTricks#filter-in-place
 		n := 0
 		for _, torrent := range torrents {
@@ -123,17 +225,18 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 		var torrents2160p []imdb2torrent.Result
 		var torrents2160p10bit []imdb2torrent.Result
 		for _, torrent := range torrents {
-			if strings.HasPrefix(torrent.Quality, "720p") {
+			switch qualityGroup(torrent.Quality) {
+			case "720p":
 				torrents720p = append(torrents720p, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "1080p") && strings.Contains(torrent.Quality, "10bit") {
+			case "1080p.10bit":
 				torrents1080p10bit = append(torrents1080p10bit, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "1080p") {
+			case "1080p":
 				torrents1080p = append(torrents1080p, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "2160p") && strings.Contains(torrent.Quality, "10bit") {
+			case "2160p.10bit":
 				torrents2160p10bit = append(torrents2160p10bit, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "2160p") {
+			case "2160p":
 				torrents2160p = append(torrents2160p, torrent)
-			} else {
+			default:
 				logger.Warn("Unknown quality, can't sort into one of the torrent lists", zap.String("quality", torrent.Quality))
 			}
 		}
@@ -152,43 +255,210 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 		// There it should usually work for the first torrent we try, because we already checked the "instant availability" on RealDebrid here. If the "instant availability" info is stale (because we cached it), the next torrent will be used.
 		var streams []stremio.StreamItem
 		if len(torrents720p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-720p", "720p", torrents720p)
+			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-720p", "720p", debridID, torrents720p, titleTemplate, logger)
 			streams = append(streams, stream)
 		}
 		if len(torrents1080p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p", "1080p", torrents1080p)
+			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p", "1080p", debridID, torrents1080p, titleTemplate, logger)
 			streams = append(streams, stream)
 		}
 		if len(torrents1080p10bit) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p.10bit", "1080p 10bit", torrents1080p10bit)
+			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p.10bit", "1080p 10bit", debridID, torrents1080p10bit, titleTemplate, logger)
 			streams = append(streams, stream)
 		}
 		if len(torrents2160p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p", "2160p", torrents2160p)
+			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p", "2160p", debridID, torrents2160p, titleTemplate, logger)
 			streams = append(streams, stream)
 		}
 		if len(torrents2160p10bit) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p.10bit", "2160p 10bit", torrents2160p10bit)
+			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p.10bit", "2160p 10bit", debridID, torrents2160p10bit, titleTemplate, logger)
 			streams = append(streams, stream)
 		}
+		if underMaintenance {
+			streams = append(streams, createMaintenanceStreamItem(config, udString, debridID))
+		}
+		timings.track("createStreams")
 
 		return streams, nil
 	}
 }
 
-func createStreamItem(ctx context.Context, config config, encodedUserData string, redirectID, quality string, torrents []imdb2torrent.Result) stremio.StreamItem {
+// createMaintenanceStreamItem creates a stream item that lets the user know that the debrid service is under maintenance.
+// It points to a redirect ID without cached torrents, so when the user clicks on it, the redirect handler responds with the maintenance message.
+func createMaintenanceStreamItem(config config, encodedUserData, debridID string) stremio.StreamItem {
+	return stremio.StreamItem{
+		URL:   config.BaseURL + "/" + encodedUserData + "/redirect/maintenance",
+		Title: debridNames[debridID] + " is under maintenance.\nOnly previously watched streams can be played.",
+	}
+}
+
+// debridNames maps the debrid service IDs to their names
+var debridNames = map[string]string{
+	"rd": "RealDebrid",
+	"ad": "AllDebrid",
+	"pm": "Premiumize",
+}
+
+// streamTitleData is the data that's available in the stream title template.
+type streamTitleData struct {
+	// Like "1080p 10bit", or the exact quality of the torrent if there's only one, like "1080p (web, 10bit)"
+	Quality string
+	// Like "RealDebrid"
+	Provider string
+	// Title of the first torrent that will be tried to be converted into a stream, like "Big Buck Bunny (2008) [1080p] [YTS.MX]"
+	Title string
+	// Number of torrents that will be tried to be converted into a stream, in case the previous ones fail
+	Torrents int
+}
+
+// sanitizeTitle replaces control characters (like newlines) in a torrent title with spaces
+// and shortens it, so that it can't break the stream list layout in Stremio.
+func sanitizeTitle(title string) string {
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, title)
+	title = strings.Join(strings.Fields(title), " ")
+	if runes := []rune(title); len(runes) > 100 {
+		title = string(runes[:99]) + "…"
+	}
+	return title
+}
+
+// qualityGroup returns the group a torrent's quality belongs to, which is one of "720p", "1080p", "1080p.10bit", "2160p" and "2160p.10bit".
+// An empty string is returned for unknown qualities.
+func qualityGroup(quality string) string {
+	if strings.HasPrefix(quality, "720p") {
+		return "720p"
+	} else if strings.HasPrefix(quality, "1080p") && strings.Contains(quality, "10bit") {
+		return "1080p.10bit"
+	} else if strings.HasPrefix(quality, "1080p") {
+		return "1080p"
+	} else if strings.HasPrefix(quality, "2160p") && strings.Contains(quality, "10bit") {
+		return "2160p.10bit"
+	} else if strings.HasPrefix(quality, "2160p") {
+		return "2160p"
+	}
+	return ""
+}
+
+// cachedInfoHashes returns the info hashes of the torrents that are cached as available and not expired yet.
+func cachedInfoHashes(torrents []imdb2torrent.Result, availabilityCache debrid.Cache, cacheAge time.Duration) []string {
+	var result []string
+	for _, torrent := range torrents {
+		// Errors are treated as cache misses
+		created, found, err := availabilityCache.Get(torrent.InfoHash)
+		if err == nil && found && time.Since(created) <= cacheAge {
+			result = append(result, torrent.InfoHash)
+		}
+	}
+	return result
+}
+
+// selectAvailabilityCandidates splits the torrents' info hashes into the ones that should be checked for instant availability now, and the overflow that can be checked later.
+// Info hashes that are cached as available and not expired yet are always candidates, because the debrid clients don't send a request for them.
+// Of the remaining ones at most maxUncached are candidates. They're picked alternating between the quality groups, so that for example a long list of 720p torrents doesn't crowd out all 2160p torrents.
+// Within a quality group the original order is kept.
+// maxUncached <= 0 means no limit.
+func selectAvailabilityCandidates(torrents []imdb2torrent.Result, availabilityCache debrid.Cache, cacheAge time.Duration, maxUncached int) (candidates, overflow []string) {
+	var groups []string
+	uncachedByGroup := map[string][]string{}
+	for _, torrent := range torrents {
+		if maxUncached <= 0 {
+			candidates = append(candidates, torrent.InfoHash)
+			continue
+		}
+		// Errors are treated as cache misses. The debrid client logs them when it does the same lookup.
+		created, found, err := availabilityCache.Get(torrent.InfoHash)
+		if err == nil && found && time.Since(created) <= cacheAge {
+			candidates = append(candidates, torrent.InfoHash)
+			continue
+		}
+		group := qualityGroup(torrent.Quality)
+		if _, ok := uncachedByGroup[group]; !ok {
+			groups = append(groups, group)
+		}
+		uncachedByGroup[group] = append(uncachedByGroup[group], torrent.InfoHash)
+	}
+
+	// Round robin between the groups
+	uncachedCount := 0
+	for i := 0; len(groups) > 0; i++ {
+		n := 0
+		for _, group := range groups {
+			if i >= len(uncachedByGroup[group]) {
+				continue
+			}
+			if uncachedCount < maxUncached {
+				candidates = append(candidates, uncachedByGroup[group][i])
+				uncachedCount++
+			} else {
+				overflow = append(overflow, uncachedByGroup[group][i])
+			}
+			// Keep the group for the next round
+			groups[n] = group
+			n++
+		}
+		groups = groups[:n]
+	}
+
+	return candidates, overflow
+}
+
+// withoutUnavailable returns the torrents that the debrid service didn't recently report as not instantly available.
+// The passed slice isn't modified, because the stream handler still needs all torrents.
+func withoutUnavailable(torrents []imdb2torrent.Result, unavailableCache debrid.Cache, debridID string, cacheAge time.Duration) []imdb2torrent.Result {
+	var result []imdb2torrent.Result
+	for _, torrent := range torrents {
+		// Errors are treated as cache misses, so the torrent is just checked again
+		created, found, err := unavailableCache.Get(debridID + "-" + torrent.InfoHash)
+		if err == nil && found && time.Since(created) <= cacheAge {
+			continue
+		}
+		result = append(result, torrent)
+	}
+	return result
+}
+
+// markUnavailable caches the info hashes that the debrid service reported as not instantly available.
+func markUnavailable(unavailableCache debrid.Cache, debridID string, unavailable []string) {
+	for _, infoHash := range unavailable {
+		// A failed Set only means that the torrent is checked again next time
+		_ = unavailableCache.Set(debridID + "-" + infoHash)
+	}
+}
+
+func createStreamItem(ctx context.Context, config config, encodedUserData string, redirectID, quality, debridID string, torrents []imdb2torrent.Result, titleTemplate *template.Template, logger *zap.Logger) stremio.StreamItem {
 	// Path escaping required for TV shows, which contain ":"
 	redirectID = url.PathEscape(redirectID)
 	stream := stremio.StreamItem{
 		URL: config.BaseURL + "/" + encodedUserData + "/redirect/" + redirectID,
-		// Stremio docs recommend to use the stream quality as title.
-		// See https://github.com/Stremio/stremio-addon-sdk/blob/ddaa3b80def8a44e553349734dd02ec9c3fea52c/docs/api/responses/stream.md#additional-properties-to-provide-information--behaviour-flags
-		Title: quality,
+	}
+	titleData := streamTitleData{
+		Quality:  quality,
+		Provider: debridNames[debridID],
+		Title:    sanitizeTitle(torrents[0].Title),
+		Torrents: len(torrents),
 	}
 	// We can only set the exact quality string if there's only one torrent.
 	// Otherwise maybe the upcoming RealDebrid conversion fails for one torrent, but works for the next, which has a slightly different quality string.
 	if len(torrents) == 1 {
-		stream.Title = torrents[0].Quality
+		titleData.Quality = torrents[0].Quality
+	}
+	// The default template only contains the quality, because the Stremio docs recommend to use the stream quality as title.
+	// See https://github.com/Stremio/stremio-addon-sdk/blob/ddaa3b80def8a44e553349734dd02ec9c3fea52c/docs/api/responses/stream.md#additional-properties-to-provide-information--behaviour-flags
+	title := &strings.Builder{}
+	if err := titleTemplate.Execute(title, titleData); err != nil {
+		logger.Error("Couldn't execute stream title template, using quality as title", zap.Error(err))
+		stream.Title = titleData.Quality
+	} else {
+		stream.Title = title.String()
+	}
+	// In read-only mode the torrents can't be added to the user's debrid account, so let the user know before clicking on the stream.
+	if config.ReadOnly {
+		stream.Title += "\n(Maintenance: Only previously watched)"
 	}
 
 	// Create and assign lock object.
@@ -202,7 +472,14 @@ func createStreamItem(ctx context.Context, config config, encodedUserData string
 	return stream
 }
 
-func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
+func createRedirectHandler(redirectCache, streamCache goCacher, providers map[string]debridProvider, streamExpiration time.Duration, eventBus *events.Bus, maintenance *maintenanceTracker, readOnly, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
+	linkCheckClient := &http.Client{
+		Timeout: 2 * time.Second,
+		// A redirect to the actual file server would be fine, but we don't need to follow it
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 	return func(c *fiber.Ctx) error {
 		logger.Debug("redirectHandler called", zap.String("request", fmt.Sprintf("%+v", c.Request())))
 
@@ -213,6 +490,11 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 		}
 		zapFieldRedirectID := zap.String("redirectID", redirectID)
 
+		// Parse userData.
+		// No need to check if decoding worked, because the token middleware does that already.
+		userData, _ := decodeUserData(udString, logger)
+		debridID := userData.debridID()
+
 		// Before we look into the cache, we need to set a lock so that concurrent calls to this endpoint (including the redirectID) don't unnecessarily lead to the full sharade of RD requests again, only because the first handling of the request wasn't fast enough to fill the cache.
 		// The lock objects are created in the stream handler. But if the service was restarted the map is empty. So we need to create lock objects in that case for the users arriving at the redirect handler without having been at the stream handler after a service restart.
 		redirectLockMapLock.Lock()
@@ -228,12 +510,15 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 		// This cache is important, because for a single click on a stream in Stremio there are multiple requests to this endpoint in a short timeframe.
 		// This cache is also useful for when a user resumes his stream via Stremio after closing it. In this case the same RealDebrid HTTP stream must be delivered (or even if it would work with another one, using the same one would be beneficial).
 		// Because the actual stream URLs are cached here, it MUST be user-specific! No need to use the full userData string though - we just hash it and use that as "user identifier".
-		// TODO: Regarding stream resuming: We don't know how long RD / AD / PM HTTP stream URLs are valid. If it's shorter, we can shorten this as well. Also see similar TODO comment in main.go file.
+		// We don't know how long RD / AD / PM HTTP stream URLs are valid, so when a user resumes a stream later, the cached URL is checked first.
 		userHash := sha256.Sum256([]byte(udString))
 		userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
 		streamCacheID := userHashEncoded + "-" + redirectID
-		if streamURLiface, found := streamCache.Get(streamCacheID); found {
+		if streamURLiface, found := streamCache.Get(streamCacheID); !found {
+			eventBus.Publish(events.Event{Type: events.StreamCacheMiss, Provider: debridID, RedirectID: redirectID})
+		} else {
 			logger.Debug("Hit stream cache", zapFieldRedirectID)
+			eventBus.Publish(events.Event{Type: events.StreamCacheHit, Provider: debridID, RedirectID: redirectID})
 			if streamURLitem, ok := streamURLiface.(cacheItem); !ok {
 				logger.Error("Stream cache item couldn't be cast into cacheItem", zap.String("cacheItemType", fmt.Sprintf("%T", streamURLiface)), zapFieldRedirectID)
 			} else if len(streamURLitem.Value) == 0 && time.Since(streamURLitem.Created) > time.Minute {
@@ -241,6 +526,10 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 			} else if len(streamURLitem.Value) == 0 {
 				logger.Warn("The torrents for this stream where previously tried to be converted into a stream but it didn't work", zapFieldRedirectID)
 				return c.SendStatus(fiber.StatusNotFound)
+			} else if time.Since(streamURLitem.Created) > time.Minute && isStreamGone(c.Context(), linkCheckClient, streamURLitem.Value) {
+				// Stremio sends multiple requests in a short timeframe for a single click, no need to check the URL for each of them.
+				// The cache item gets overwritten after the torrents are converted into a stream again.
+				logger.Info("Cached stream URL is gone, converting the torrents into a stream again", zapFieldRedirectID)
 			} else {
 				logger.Debug("Responding with redirect to stream", zap.String("redirectLocation", streamURLitem.Value), zapFieldRedirectID)
 				c.Set("Location", streamURLitem.Value)
@@ -248,6 +537,11 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 			}
 		}
 
+		// Before the lookup of the torrents, because the stream item that informs about the maintenance points to a redirect ID without torrents.
+		if maintenance.active(debridID) {
+			logger.Info("Debrid service is under maintenance, not trying to convert torrents into a stream URL", zapFieldRedirectID)
+			return c.Status(fiber.StatusServiceUnavailable).SendString(maintenanceMsg)
+		}
 		// Here we get the data from the cache that the stream handler filled.
 		torrentsIface, found := redirectCache.Get(redirectID)
 		if !found {
@@ -260,29 +554,47 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 			logger.Error("Torrents cache item couldn't be cast into []imdb2torrent.Result", zap.String("cacheItemType", fmt.Sprintf("%T", torrentsIface)), zapFieldRedirectID)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		// Parse userData.
-		// No need to check if decoding worked, because the token middleware does that already.
-		userData, _ := decodeUserData(udString, logger)
+		// Converting the torrents into a stream URL requires adding them to the user's debrid account.
+		// Not caching anything here, so that the stream works right away when read-only mode is disabled again.
+		if readOnly {
+			logger.Info("Can't convert torrents into a stream URL in read-only mode", zapFieldRedirectID)
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Deflix is in read-only mode, so only previously watched streams can be played. Please try again later.")
+		}
 		var streamURL string
 		var err error
 		keyOrToken := c.Locals("deflix_keyOrToken").(string)
 		if forwardOriginIP && len(c.IPs()) > 0 {
 			c.Locals("debrid_originIP", c.IPs()[0])
 		}
+		timings, _ := c.Locals("deflix_stageTimings").(*stageTimings)
+		timings.track("prepareResolution")
+		eventBus.Publish(events.Event{Type: events.ResolutionStarted, Provider: debridID, RedirectID: redirectID})
+		startResolution := time.Now()
+		provider := providers[debridID]
+		remote := userData.RDremote && provider.Capabilities().Remote
 		for _, torrent := range torrents {
-			if userData.RDtoken != "" || userData.RDoauth2 != "" {
-				streamURL, err = rdClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken, userData.RDremote)
-			} else if userData.ADkey != "" {
-				streamURL, err = adClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken)
-			} else {
-				streamURL, err = pmClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken)
-			}
+			streamURL, err = provider.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken, remote)
 			if err != nil {
 				logger.Warn("Couldn't get stream URL", zap.Error(err), zapFieldRedirectID)
+				eventBus.Publish(events.Event{Type: events.ProviderError, Provider: debridID, RedirectID: redirectID, Error: err.Error()})
+				// Not caching the failure, so that the stream works right away after the maintenance
+				if maintenance.report(debridID, err) {
+					return c.Status(fiber.StatusServiceUnavailable).SendString(maintenanceMsg)
+				}
+				// The other torrents would be rate limited as well, and an empty stream URL must not be cached in this case either
+				if isRateLimitErr(err) {
+					return c.Status(fiber.StatusTooManyRequests).SendString(rateLimitMsg)
+				}
 			} else {
 				break
 			}
 		}
+		timings.track("resolution")
+		if streamURL == "" {
+			eventBus.Publish(events.Event{Type: events.ResolutionFailed, Provider: debridID, RedirectID: redirectID, Error: "none of the torrents could be converted into a stream", Duration: time.Since(startResolution)})
+		} else {
+			eventBus.Publish(events.Event{Type: events.ResolutionSucceeded, Provider: debridID, RedirectID: redirectID, Duration: time.Since(startResolution)})
+		}
 
 		// Fill cache, even if no actual video stream was found, because it seems to be the current state on RealDebrid
 		streamURLitem := cacheItem{
@@ -301,7 +613,22 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 	}
 }
 
-func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, goCaches map[string]*gocache.Cache, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
+// isStreamGone checks if the debrid service responds with "404 Not Found" to the stream URL, which happens for example when the user deleted the torrent from their account.
+// Any other response or error leads to false, because the URL might still work for the user.
+func isStreamGone(ctx context.Context, client *http.Client, streamURL string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, streamURL, nil)
+	if err != nil {
+		return false
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusNotFound
+}
+
+func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, goCaches map[string]persistableCache, creationCaches map[string]*creationCache, readOnly, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		logger.Debug("statusHandler called", zap.String("request", fmt.Sprintf("%+v", c.Request())))
 
@@ -358,51 +685,56 @@ func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher,
 
 		// Check debrid clients
 
-		if forwardOriginIP && len(c.IPs()) > 0 {
-			c.Locals("debrid_originIP", c.IPs()[0])
-		}
+		// Getting a stream URL adds the torrent to the debrid account, which isn't allowed in read-only mode.
+		if readOnly {
+			res += "\t" + `"debridClients": "skipped in read-only mode",` + "\n"
+		} else {
+			if forwardOriginIP && len(c.IPs()) > 0 {
+				c.Locals("debrid_originIP", c.IPs()[0])
+			}
 
-		// Check RD client
+			// Check RD client
 
-		res += "\t" + `"RD": {` + "\n"
-		startRD := time.Now()
-		streamURL, err := rdClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, rdToken, false)
-		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
-		}
-		durationRDmillis := time.Since(startRD).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationRDmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
+			res += "\t" + `"RD": {` + "\n"
+			startRD := time.Now()
+			streamURL, err := rdClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, rdToken, false)
+			if err != nil {
+				res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
+			} else {
+				res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+			}
+			durationRDmillis := time.Since(startRD).Milliseconds()
+			res += "\t\t" + `"duration": "` + strconv.FormatInt(durationRDmillis, 10) + `ms"` + "\n"
+			res += "\t" + `},` + "\n"
 
-		// Check AD client
+			// Check AD client
 
-		res += "\t" + `"AD": {` + "\n"
-		startAD := time.Now()
-		streamURL, err = adClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, adKey)
-		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
-		}
-		durationADmillis := time.Since(startAD).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationADmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
+			res += "\t" + `"AD": {` + "\n"
+			startAD := time.Now()
+			streamURL, err = adClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, adKey)
+			if err != nil {
+				res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
+			} else {
+				res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+			}
+			durationADmillis := time.Since(startAD).Milliseconds()
+			res += "\t\t" + `"duration": "` + strconv.FormatInt(durationADmillis, 10) + `ms"` + "\n"
+			res += "\t" + `},` + "\n"
 
-		// Check PM client
+			// Check PM client
 
-		res += "\t" + `"PM": {` + "\n"
-		startPM := time.Now()
-		streamURL, err = pmClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, pmKey)
-		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+			res += "\t" + `"PM": {` + "\n"
+			startPM := time.Now()
+			streamURL, err = pmClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, pmKey)
+			if err != nil {
+				res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
+			} else {
+				res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+			}
+			durationPMmillis := time.Since(startPM).Milliseconds()
+			res += "\t\t" + `"duration": "` + strconv.FormatInt(durationPMmillis, 10) + `ms"` + "\n"
+			res += "\t" + `},` + "\n"
 		}
-		durationPMmillis := time.Since(startPM).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationPMmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
 
 		// Check caches
 
@@ -414,6 +746,18 @@ func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher,
 		}
 		res = strings.TrimRight(res, ",\n") + "\n"
 		res += "\t" + `},` + "\n"
+		res += "\t" + `"cacheStats": {` + "\n"
+		for name, cache := range creationCaches {
+			stats := cache.Stats()
+			res += "\t\t" + `"` + name + `": {` + "\n"
+			res += "\t\t\t" + `"Hits": "` + strconv.FormatInt(stats.Hits, 10) + `",` + "\n"
+			res += "\t\t\t" + `"Misses": "` + strconv.FormatInt(stats.Misses, 10) + `",` + "\n"
+			res += "\t\t\t" + `"Expired": "` + strconv.FormatInt(stats.Expired, 10) + `",` + "\n"
+			res += "\t\t\t" + `"WriteErrors": "` + strconv.FormatInt(stats.WriteErrors, 10) + `"` + "\n"
+			res += "\t\t" + `},` + "\n"
+		}
+		res = strings.TrimRight(res, ",\n") + "\n"
+		res += "\t" + `},` + "\n"
 
 		durationMillis := time.Since(start).Milliseconds()
 		res += "\t" + `"duration": "` + strconv.FormatInt(durationMillis, 10) + `ms"` + "\n"
@@ -424,3 +768,69 @@ func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher,
 		return c.SendString(res)
 	}
 }
+
+type validateTokenRequest struct {
+	// "rd", "ad" or "pm"
+	Service string `json:"service"`
+	Token   string `json:"token"`
+}
+
+// Token validation states
+const (
+	tokenStateValid   = "valid"
+	tokenStateInvalid = "invalid"
+	// The debrid service couldn't check the token/key, for example because of maintenance, rate limiting or a connection error
+	tokenStateUnknown = "unknown"
+)
+
+type validateTokenResponse struct {
+	Valid bool   `json:"valid"`
+	State string `json:"state"`
+}
+
+// createValidateTokenHandler creates a handler that checks whether a RealDebrid API token, AllDebrid API key or Premiumize API key is valid.
+// The configure webpage uses it to give users feedback right after they pasted the token/key.
+// The token/key is sent in the request body, so that it doesn't end up in access logs.
+// When the debrid service couldn't check the token/key, for example during maintenance, the state is "unknown" instead of "invalid",
+// so that users don't replace a valid token/key. The error isn't part of the response, because it contains details of the request to the debrid service.
+func createValidateTokenHandler(providers map[string]debridProvider, maintenance *maintenanceTracker, retry *retrier, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := validateTokenRequest{}
+		if err := c.BodyParser(&req); err != nil {
+			logger.Info("Couldn't parse token validation request body", zap.Error(err))
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if req.Token == "" {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+
+		provider, ok := providers[req.Service]
+		if !ok {
+			logger.Info("Unknown debrid service in token validation request", zap.String("service", req.Service))
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if maintenance.active(req.Service) {
+			return c.JSON(validateTokenResponse{State: tokenStateUnknown})
+		}
+		err := retry.do(c.Context(), func() error { return provider.TestToken(c.Context(), req.Token) })
+
+		res := validateTokenResponse{
+			Valid: err == nil,
+			State: tokenStateValid,
+		}
+		if err != nil {
+			logger.Debug("Token is invalid or validation failed", zap.Error(err), zap.String("service", req.Service))
+			res.State = tokenState(maintenance, req.Service, err)
+		}
+		return c.JSON(res)
+	}
+}
+
+// tokenState returns the token validation state for an error from a debrid client.
+// Only errors that aren't from maintenance, rate limiting or connection problems mean that the token/key is invalid.
+func tokenState(maintenance *maintenanceTracker, debridID string, err error) string {
+	if maintenance.report(debridID, err) || isMaintenanceErr(err) || isRateLimitErr(err) || isTransientErr(err) {
+		return tokenStateUnknown
+	}
+	return tokenStateInvalid
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestSelectAvailabilityCandidates(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{InfoHash: "A1", Quality: "720p"},
+		{InfoHash: "A2", Quality: "720p"},
+		{InfoHash: "A3", Quality: "720p (web)"},
+		{InfoHash: "B1", Quality: "1080p"},
+		{InfoHash: "C1", Quality: "2160p 10bit"},
+		{InfoHash: "C2", Quality: "2160p 10bit"},
+	}
+	cache := debrid.NewInMemoryCache()
+	// Cached ones don't count towards the limit
+	require.NoError(t, cache.Set("A2"))
+
+	candidates, overflow := selectAvailabilityCandidates(torrents, cache, time.Hour, 3)
+	require.Equal(t, []string{"A2", "A1", "B1", "C1"}, candidates)
+	require.Equal(t, []string{"A3", "C2"}, overflow)
+
+	// Expired cache items do count towards the limit
+	candidates, overflow = selectAvailabilityCandidates(torrents, cache, 0, 3)
+	require.Equal(t, []string{"A1", "B1", "C1"}, candidates)
+	require.Equal(t, []string{"A2", "C2", "A3"}, overflow)
+
+	// No limit
+	candidates, overflow = selectAvailabilityCandidates(torrents, cache, time.Hour, 0)
+	require.Equal(t, []string{"A1", "A2", "A3", "B1", "C1", "C2"}, candidates)
+	require.Empty(t, overflow)
+}
+
+func TestCreateStreamItemTitle(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{Title: "Big Buck Bunny\n(2008)\t[1080p]", Quality: "1080p (web)"},
+	}
+	tmpl := template.Must(template.New("streamTitle").Parse("{{.Quality}} | {{.Provider}} | {{.Torrents}}\n{{.Title}}"))
+	stream := createStreamItem(context.Background(), config{}, "foo", "tt1254207-rd-1080p", "1080p", "rd", torrents, tmpl, zap.NewNop())
+	require.Equal(t, "1080p (web) | RealDebrid | 1\nBig Buck Bunny (2008) [1080p]", stream.Title)
+
+	// With multiple torrents the exact quality can't be known yet
+	torrents = append(torrents, imdb2torrent.Result{Title: "Big Buck Bunny", Quality: "1080p"})
+	stream = createStreamItem(context.Background(), config{}, "foo", "tt1254207-rd-1080p", "1080p", "rd", torrents, tmpl, zap.NewNop())
+	require.Equal(t, "1080p | RealDebrid | 2\nBig Buck Bunny (2008) [1080p]", stream.Title)
+}
+
+func TestIsStreamGone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodHead, r.Method)
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	require.False(t, isStreamGone(ctx, ts.Client(), ts.URL+"/ok"))
+	require.True(t, isStreamGone(ctx, ts.Client(), ts.URL+"/gone"))
+	// Only a 404 means the stream is gone
+	require.False(t, isStreamGone(ctx, ts.Client(), ts.URL+"/unavailable"))
+}
+
+func TestCachedInfoHashes(t *testing.T) {
+	cache := debrid.NewInMemoryCache()
+	require.NoError(t, cache.Set("A2"))
+	require.NoError(t, cache.Set("A3"))
+	torrents := []imdb2torrent.Result{{InfoHash: "A1"}, {InfoHash: "A2"}, {InfoHash: "A3"}}
+
+	require.Equal(t, []string{"A2", "A3"}, cachedInfoHashes(torrents, cache, time.Minute))
+	// Expired
+	require.Empty(t, cachedInfoHashes(torrents, cache, 0))
+}
+
+func TestUnavailableCache(t *testing.T) {
+	cache := debrid.NewInMemoryCache()
+	torrents := []imdb2torrent.Result{{InfoHash: "A1"}, {InfoHash: "A2"}, {InfoHash: "A3"}}
+
+	markUnavailable(cache, "rd", []string{"A1"})
+	require.Equal(t, []imdb2torrent.Result{{InfoHash: "A2"}, {InfoHash: "A3"}}, withoutUnavailable(torrents, cache, "rd", time.Minute))
+	// Availability differs between debrid services
+	require.Equal(t, torrents, withoutUnavailable(torrents, cache, "ad", time.Minute))
+	// Expired
+	require.Equal(t, torrents, withoutUnavailable(torrents, cache, "rd", 0))
+}
+
+func TestTokenState(t *testing.T) {
+	maintenance := newMaintenanceTracker(time.Minute, nil, zap.NewNop())
+
+	require.Equal(t, tokenStateInvalid, tokenState(maintenance, "rd", errors.New("Couldn't fetch user info from real-debrid.com with the provided token: bad HTTP response status: 401 Unauthorized")))
+	require.Equal(t, tokenStateUnknown, tokenState(maintenance, "rd", errors.New("Couldn't send GET request")))
+	require.Equal(t, tokenStateUnknown, tokenState(maintenance, "rd", errors.New("bad HTTP response status: 429 Too Many Requests")))
+	require.Equal(t, tokenStateUnknown, tokenState(maintenance, "rd", errors.New("bad HTTP response status: 503 Service Unavailable")))
+	require.True(t, maintenance.active("rd"))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+)
+
+var _ persistableCache = (*lruCache)(nil)
+
+// lruCache is an in-memory cache with a max number of entries, which evicts the least recently used entry when it's full.
+// Unlike go-cache it doesn't need a janitor, because expired entries are removed when they're read or evicted.
+// But it can't know about expired entries that are never read again, so DeleteExpired can be called periodically to free memory before the cache is full.
+type lruCache struct {
+	maxEntries int
+	expiration time.Duration
+	// Most recently used entries are at the front
+	entries  *list.List
+	elements map[string]*list.Element
+	lock     *sync.Mutex
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	// Unix nanoseconds, 0 means the entry doesn't expire
+	expiration int64
+}
+
+// newLRUCache creates an lruCache, filled with the given (persisted) items.
+// If there are more items than maxEntries, the ones that expire first are dropped.
+func newLRUCache(maxEntries int, expiration time.Duration, items map[string]gocache.Item) *lruCache {
+	c := &lruCache{
+		maxEntries: maxEntries,
+		expiration: expiration,
+		entries:    list.New(),
+		elements:   map[string]*list.Element{},
+		lock:       &sync.Mutex{},
+	}
+	// The ones that were set last expire last, so adding them in that order restores the usage order approximately
+	keys := make([]string, 0, len(items))
+	for k, item := range items {
+		if !item.Expired() {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return items[keys[i]].Expiration < items[keys[j]].Expiration
+	})
+	for _, k := range keys {
+		c.add(k, items[k].Object, items[k].Expiration)
+	}
+	return c
+}
+
+// Set adds the value with the cache's default expiration and marks it as most recently used.
+func (c *lruCache) Set(k string, v interface{}) {
+	var expiration int64
+	if c.expiration > 0 {
+		expiration = time.Now().Add(c.expiration).UnixNano()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(k, v, expiration)
+}
+
+// setWithExpiration adds the value with the given expiration in Unix nanoseconds, for example from persisted items.
+func (c *lruCache) setWithExpiration(k string, v interface{}, expiration int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(k, v, expiration)
+}
+
+func (c *lruCache) add(k string, v interface{}, expiration int64) {
+	if element, ok := c.elements[k]; ok {
+		c.entries.MoveToFront(element)
+		entry := element.Value.(*lruEntry)
+		entry.value = v
+		entry.expiration = expiration
+		return
+	}
+	c.elements[k] = c.entries.PushFront(&lruEntry{key: k, value: v, expiration: expiration})
+	if c.entries.Len() > c.maxEntries {
+		c.remove(c.entries.Back())
+	}
+}
+
+// Get returns the value if it exists and isn't expired, and marks it as most recently used.
+func (c *lruCache) Get(k string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.elements[k]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if entry.expiration > 0 && time.Now().UnixNano() > entry.expiration {
+		c.remove(element)
+		return nil, false
+	}
+	c.entries.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache) remove(element *list.Element) {
+	c.entries.Remove(element)
+	delete(c.elements, element.Value.(*lruEntry).key)
+}
+
+// DeleteExpired removes all expired entries, like the go-cache method with the same name.
+func (c *lruCache) DeleteExpired() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now().UnixNano()
+	for element := c.entries.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*lruEntry); entry.expiration > 0 && now > entry.expiration {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// Flush removes all entries.
+func (c *lruCache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries.Init()
+	c.elements = map[string]*list.Element{}
+}
+
+// Items returns the unexpired entries in the same format as go-cache, so they can be persisted the same way.
+func (c *lruCache) Items() map[string]gocache.Item {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now().UnixNano()
+	items := make(map[string]gocache.Item, len(c.elements))
+	for k, element := range c.elements {
+		entry := element.Value.(*lruEntry)
+		if entry.expiration > 0 && now > entry.expiration {
+			continue
+		}
+		items[k] = gocache.Item{
+			Object:     entry.value,
+			Expiration: entry.expiration,
+		}
+	}
+	return items
+}
+
+// ItemCount returns the number of entries, including expired ones that weren't removed yet.
+func (c *lruCache) ItemCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries.Len()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2, time.Hour, nil)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	// Makes "b" the least recently used one
+	_, found := c.Get("a")
+	require.True(t, found)
+	c.Set("c", 3)
+	_, found = c.Get("b")
+	require.False(t, found)
+	v, found := c.Get("a")
+	require.True(t, found)
+	require.Equal(t, 1, v)
+	require.Equal(t, 2, c.ItemCount())
+
+	// Expired entries
+	c = newLRUCache(2, time.Nanosecond, nil)
+	c.Set("a", 1)
+	time.Sleep(time.Millisecond)
+	_, found = c.Get("a")
+	require.False(t, found)
+	require.Equal(t, 0, c.ItemCount())
+	// Expired entries that aren't read anymore
+	c.Set("a", 1)
+	c.Set("b", 2)
+	time.Sleep(time.Millisecond)
+	require.Equal(t, 2, c.ItemCount())
+	c.DeleteExpired()
+	require.Equal(t, 0, c.ItemCount())
+
+	c = newLRUCache(2, time.Hour, nil)
+	c.Set("a", 1)
+	c.Flush()
+	_, found = c.Get("a")
+	require.False(t, found)
+	require.Equal(t, 0, c.ItemCount())
+}
+
+func TestLRUCacheItems(t *testing.T) {
+	now := time.Now()
+	items := map[string]gocache.Item{
+		"a": {Object: 1, Expiration: now.Add(time.Minute).UnixNano()},
+		"b": {Object: 2, Expiration: now.Add(2 * time.Minute).UnixNano()},
+		"c": {Object: 3, Expiration: now.Add(3 * time.Minute).UnixNano()},
+		"d": {Object: 4, Expiration: now.Add(-time.Minute).UnixNano()},
+	}
+	// The expired one and the one that expires first are dropped
+	c := newLRUCache(2, time.Hour, items)
+	require.Equal(t, map[string]gocache.Item{"b": items["b"], "c": items["c"]}, c.Items())
+}
@@ -4,16 +4,20 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/dgraph-io/badger/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/markbates/pkger"
@@ -23,12 +27,14 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
+	"github.com/deflix-tv/go-debrid"
 	"github.com/deflix-tv/go-debrid/alldebrid"
 	"github.com/deflix-tv/go-debrid/premiumize"
 	"github.com/deflix-tv/go-debrid/realdebrid"
 	"github.com/deflix-tv/go-stremio"
 	"github.com/deflix-tv/go-stremio/pkg/cinemeta"
 	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/events"
 	"github.com/doingodswork/deflix-stremio/pkg/logadapter"
 	"github.com/doingodswork/deflix-stremio/pkg/metafetcher"
 )
@@ -74,13 +80,6 @@ var (
 	// 24h so that a user who selects a movie and sees the list of streams can click on a stream within this time.
 	// If a user stops/exits a stream and later resumes it, Stremio sends him to the redirect handler. If the stream cache doesn't hold the cache anymore, we just get fresh torrents - no need to cache this for so long.
 	redirectExpiration = 24 * time.Hour
-	// Expiration for the converted stream inside the stream handler.
-	// A long expiration is important for a user who stops/exits a stream and later resumes it. Stremio sends him to the redirect handler.
-	// 10 days: weekend -> next weekend.
-	// TODO: We don't know how long an RealDebrid stream URL is valid - so maybe this should be shorter (returning an invalid stream URL is worse then doing another torrent lookup + RealDebrid conversion, but keep in mind that the video player might have issues when another URL of the same file, or a completely other file (for example because the previous one isn't available on RealDebrid anymore) is returned). Also see similar TODO comment in handlers.go file.
-	streamExpiration = 10 * 24 * time.Hour // 10 days
-	// Expiration for cached users' RealDebrid API tokens
-	tokenExpiration = 24 * time.Hour
 )
 
 // Persistent stores
@@ -97,6 +96,10 @@ var (
 	adAvailabilityCache *creationCache
 	pmAvailabilityCache *creationCache
 	tokenCache          *creationCache
+	// Torrents that the debrid services reported as not instantly available, for all debrid services
+	unavailableCache *creationCache
+	// Debrid service ID -> availability cache as it's passed to the debrid client, so that the availability warmer can refresh entries
+	clientAvailabilityCaches map[string]*refreshableCache
 	// go-cache or Redis, depending on config
 	redirectCache *goCache
 	streamCache   *goCache
@@ -123,7 +126,7 @@ func init() {
 	http.DefaultClient.Timeout = 5 * time.Second
 
 	// Make predicting "random" numbers harder
-	rand.NewSource(time.Now().UnixNano())
+	rand.Seed(time.Now().UnixNano())
 
 	// Register types for gob en- and decoding, required when using go-cache, because a go-cache item is always an `interface{}`.
 	registerTypes()
@@ -142,7 +145,9 @@ func main() {
 
 	logger.Info("Parsing config...")
 	config := parseConfig(logger)
-	configJSON, err := json.Marshal(config)
+	// Before marshaling, because for example a NaN float can't be marshaled to JSON
+	config.validate(logger)
+	configJSON, err := json.Marshal(config.redacted())
 	if err != nil {
 		logger.Fatal("Couldn't marshal config to JSON", zap.Error(err))
 	}
@@ -152,10 +157,15 @@ func main() {
 			logger.Fatal("Couldn't create new logger", zap.Error(err))
 		}
 	}
-	logger.Info("Parsed config", zap.ByteString("config", configJSON))
+	logger.Info("Parsed and validated config", zap.ByteString("config", configJSON))
 
-	config.validate(logger)
-	logger.Info("Validated config")
+	// Connect to NATS before the stores are opened, because a failed connection ends the process, which must not happen with open BadgerDB files.
+	var natsSink *events.NATSsink
+	if config.NATSurl != "" {
+		if natsSink, err = events.NewNATSsink(config.NATSurl, config.NATSsubject, timeout, logger); err != nil {
+			logger.Fatal("Couldn't connect to NATS", zap.Error(err))
+		}
+	}
 
 	// Load or create caches and stores
 
@@ -169,17 +179,71 @@ func main() {
 		}
 	}()
 
+	// Create event bus
+
+	eventBus := events.NewBus(100, logger)
+	defer func() {
+		if err := eventBus.Close(); err != nil {
+			logger.Error("Couldn't close all event sinks", zap.Error(err))
+		}
+	}()
+	eventBus.Subscribe(events.NewLogSink(logger))
+	if config.Metrics {
+		eventBus.Subscribe(events.NewMetricsSink())
+	}
+	if config.EventWebhookURL != "" {
+		eventBus.Subscribe(events.NewWebhookSink(config.EventWebhookURL, timeout, logger))
+	}
+	if natsSink != nil {
+		eventBus.Subscribe(natsSink)
+	}
+	if len(config.KafkaBrokers) > 0 {
+		eventBus.Subscribe(events.NewKafkaSink(config.KafkaBrokers, config.KafkaTopic, timeout, logger))
+	}
+
 	// Create clients
 
-	initClients(config, logger)
+	initClients(config, eventBus, logger)
+	maintenance := newMaintenanceTracker(config.MaintenanceCooldown, eventBus, logger)
+	var retry *retrier
+	if config.RetriesXD > 0 {
+		// The debrid clients use the default transport
+		retryAfter := newRetryAfterTracker(http.DefaultTransport)
+		http.DefaultTransport = retryAfter
+		retry = &retrier{maxRetries: config.RetriesXD, backoff: config.RetryBackoffXD, maxElapsed: config.RetryMaxElapsedXD, retryAfter: retryAfter}
+	}
 
 	// Init cache maps
 
-	goCaches := map[string]*gocache.Cache{
-		"availability-rd": rdAvailabilityCache.cache,
-		"availability-ad": adAvailabilityCache.cache,
-		"availability-pm": pmAvailabilityCache.cache,
-		"token":           tokenCache.cache,
+	creationCaches := map[string]*creationCache{
+		"availability-rd": rdAvailabilityCache,
+		"availability-ad": adAvailabilityCache,
+		"availability-pm": pmAvailabilityCache,
+		"unavailable":     unavailableCache,
+		"token":           tokenCache,
+	}
+	if config.FlushCaches {
+		for name, c := range creationCaches {
+			if err := c.Flush(); err != nil {
+				logger.Fatal("Couldn't flush cache", zap.Error(err), zap.String("cache", name))
+			}
+		}
+		logger.Info("Flushed availability, unavailability and token caches")
+	}
+	if config.CacheSnapshot != "" {
+		importSnapshot(config.CacheSnapshot, creationCaches, logger)
+	}
+	goCaches := map[string]persistableCache{}
+	// Only the in-memory ones
+	snapshotCaches := map[string]persistableCache{}
+	for name, c := range creationCaches {
+		if c.lru != nil {
+			goCaches[name] = c.lru
+			snapshotCaches[name] = c.lru
+		} else if c.cache != nil {
+			goCaches[name] = c.cache
+			snapshotCaches[name] = c.cache
+		}
 	}
 	if redirectCache.cache != nil {
 		goCaches["redirect"] = redirectCache.cache
@@ -192,15 +256,42 @@ func main() {
 		// Don't run at the same time as the persistence
 		time.Sleep(time.Minute)
 		for {
-			logCacheStats(goCaches, logger)
+			logCacheStats(goCaches, creationCaches, logger)
 			time.Sleep(time.Hour)
 		}
 	}()
 
 	// Prepare addon creation
 
-	movieStreamHandler := createStreamHandler(config, searchClient, rdClient, adClient, pmClient, redirectCache, false, logger)
-	tvShowStreamHandler := createStreamHandler(config, searchClient, rdClient, adClient, pmClient, redirectCache, true, logger)
+	providers := map[string]debridProvider{
+		"rd": rdProvider{rdClient},
+		"ad": adProvider{adClient},
+		"pm": pmProvider{pmClient},
+	}
+	availabilityCaches := map[string]debrid.Cache{
+		"rd": rdAvailabilityCache,
+		"ad": adAvailabilityCache,
+		"pm": pmAvailabilityCache,
+	}
+	// The config was validated already
+	titleTemplate := template.Must(template.New("streamTitle").Parse(config.StreamTitle))
+	var warmer *availabilityWarmer
+	if config.WarmIntervalXD > 0 {
+		keyOrTokens := map[string]string{}
+		if config.WarmTokenRD != "" {
+			keyOrTokens["rd"] = config.WarmTokenRD
+		}
+		if config.WarmKeyAD != "" {
+			keyOrTokens["ad"] = config.WarmKeyAD
+		}
+		if config.WarmKeyPM != "" {
+			keyOrTokens["pm"] = config.WarmKeyPM
+		}
+		warmer = newAvailabilityWarmer(providers, clientAvailabilityCaches, keyOrTokens, config.CacheAgeXD, config.WarmIntervalXD, config.WarmMaxXD, logger)
+		go warmer.run(ctx)
+	}
+	movieStreamHandler := createStreamHandler(config, searchClient, providers, availabilityCaches, unavailableCache, warmer, redirectCache, maintenance, titleTemplate, false, logger)
+	tvShowStreamHandler := createStreamHandler(config, searchClient, providers, availabilityCaches, unavailableCache, warmer, redirectCache, maintenance, titleTemplate, true, logger)
 	streamHandlers := map[string]stremio.StreamHandler{"movie": movieStreamHandler, "series": tvShowStreamHandler}
 
 	var httpFS http.FileSystem
@@ -276,6 +367,7 @@ func main() {
 		ConfigureHTMLfs: httpFS,
 		// Regular IMDb IDs or for TV shows (IMDbID:season:episode)
 		StreamIDregex: `^tt\d{7,8}(:\d+:\d+)?$`,
+		Metrics:       config.Metrics,
 	}
 
 	// Create addon
@@ -287,6 +379,8 @@ func main() {
 
 	// Customize addon
 
+	addon.SetManifestCallback(createManifestCallback(logger))
+
 	var confRD oauth2.Config
 	var confPM oauth2.Config
 	var aesKey []byte
@@ -317,22 +411,35 @@ func main() {
 		// SHA-256 result is 32 bytes, exactly as many as we need.
 		aesKey = hash[:]
 	}
-	authMiddleware := createAuthMiddleware(rdClient, adClient, pmClient, config.UseOAUTH2, confRD, confPM, aesKey, logger)
+
+	// Must be added before the auth middleware, so that its duration is included in the sampled logs
+	if config.LogSampleRate > 0 {
+		addon.AddMiddleware("/", createSamplingLogMiddleware(config.LogSampleRate, logger))
+	}
+
+	authMiddleware := createAuthMiddleware(rdClient, adClient, pmClient, config.UseOAUTH2, confRD, confPM, aesKey, maintenance, retry, logger)
 	addon.AddMiddleware("/:userData/manifest.json", authMiddleware)
 	addon.AddMiddleware("/:userData/stream/:type/:id.json", authMiddleware)
 	addon.AddMiddleware("/:userData/redirect/:id", authMiddleware)
 	// No need to set the middleware to the stream route without user data because go-stremio blocks it (with a 400 Bad Request response) if BehaviorHints.ConfigurationRequired is true.
 
 	// Requires URL query: "?imdbid=123&apitoken=foo"
-	statusEndpoint := createStatusHandler(searchClient.GetMagnetSearchers(), rdClient, adClient, pmClient, goCaches, config.ForwardOriginIP, logger)
+	statusEndpoint := createStatusHandler(searchClient.GetMagnetSearchers(), rdClient, adClient, pmClient, goCaches, creationCaches, config.ReadOnly, config.ForwardOriginIP, logger)
 	addon.AddEndpoint("GET", "/status", statusEndpoint)
 
 	// Redirects stream URLs (previously sent to Stremio) to the actual RealDebrid stream URLs
-	redirHandler := createRedirectHandler(redirectCache, streamCache, rdClient, adClient, pmClient, config.ForwardOriginIP, logger)
+	redirHandler := createRedirectHandler(redirectCache, streamCache, providers, config.CacheAgeStreams, eventBus, maintenance, config.ReadOnly, config.ForwardOriginIP, logger)
 	addon.AddEndpoint("GET", "/:userData/redirect/:id", redirHandler)
 	// Stremio sends a HEAD request before starting a stream.
 	addon.AddEndpoint("HEAD", "/:userData/redirect/:id", redirHandler)
 
+	// For instant feedback on the configure webpage. Requires a JSON body like `{"service":"rd","token":"foo"}`.
+	if config.ValidateTokenLimit > 0 {
+		addon.AddMiddleware("/api/validate-token", createRateLimitMiddleware(config.ValidateTokenLimit, config.ForwardOriginIP))
+	}
+	validateTokenHandler := createValidateTokenHandler(providers, maintenance, retry, logger)
+	addon.AddEndpoint("POST", "/api/validate-token", validateTokenHandler)
+
 	// For OAuth2 redirect handling for RealDebrid and Premiumize
 	isHTTPS := strings.HasPrefix(config.BaseURL, "https")
 	oauth2initHandler := createOAUTH2initHandler(confRD, confPM, isHTTPS, logger)
@@ -357,6 +464,35 @@ func main() {
 	}()
 
 	addon.Run(stoppingChan)
+
+	// The server is shut down at this point, so the caches don't change anymore
+	if config.CacheSnapshot != "" && len(snapshotCaches) > 0 {
+		if err := saveSnapshot(snapshotCaches, config.CacheSnapshot); err != nil {
+			logger.Error("Couldn't save cache snapshot", zap.Error(err))
+		} else {
+			logger.Info("Saved cache snapshot", zap.String("file", config.CacheSnapshot))
+		}
+	}
+}
+
+// importSnapshot adds the entries from the snapshot file to the in-memory availability and token caches.
+// A missing file isn't an error, because it's not written before the first shutdown.
+func importSnapshot(filePath string, creationCaches map[string]*creationCache, logger *zap.Logger) {
+	snapshot, err := loadSnapshot(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info("No cache snapshot found - continuing without it", zap.String("file", filePath))
+		} else {
+			logger.Error("Couldn't load cache snapshot - continuing without it", zap.Error(err))
+		}
+		return
+	}
+	for name, items := range snapshot {
+		if c, ok := creationCaches[name]; ok {
+			added := c.importItems(items)
+			logger.Info("Imported cache snapshot", zap.String("cache", name), zap.Int("added", added))
+		}
+	}
 }
 
 func initStores(config config, logger *zap.Logger) (closer func() error) {
@@ -386,13 +522,23 @@ func initStores(config config, logger *zap.Logger) (closer func() error) {
 	}
 	closers = append(closers, db.Close)
 
+	// The config was validated already
+	codec, _ := parseCodec(config.CacheCodec)
 	torrentCache = &resultStore{
 		db:        db,
 		keyPrefix: "torrent_",
+		codec:     codec,
 	}
 	cinemetaCache = &metaStore{
 		db:        db,
 		keyPrefix: "meta_",
+		codec:     codec,
+	}
+
+	if config.CachesInDB && config.RedisAddr == "" && config.MemcachedAddrs == "" {
+		for _, c := range []*creationCache{rdAvailabilityCache, adAvailabilityCache, pmAvailabilityCache, unavailableCache, tokenCache} {
+			c.db = db
+		}
 	}
 
 	// Periodically call RunValueLogGC()
@@ -415,34 +561,9 @@ func initCaches(config config, logger *zap.Logger) {
 	logger.Info("Initializing caches...")
 	start := time.Now()
 
-	rdAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-rd.gob")
-	if err != nil {
-		logger.Error("Couldn't load RD availability cache from file - continuing with an empty cache", zap.Error(err))
-		rdAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	rdAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, rdAvailabilityCacheItems),
-	}
-
-	adAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-ad.gob")
-	if err != nil {
-		logger.Error("Couldn't load AD availability cache from file - continuing with an empty cache", zap.Error(err))
-		adAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	adAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, adAvailabilityCacheItems),
-	}
-
-	pmAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-pm.gob")
-	if err != nil {
-		logger.Error("Couldn't load Premiumize availability cache from file - continuing with an empty cache", zap.Error(err))
-		pmAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	pmAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, pmAvailabilityCacheItems),
-	}
-
 	// TODO: Return closer func like in the stores initialization function.
+	// The config was validated already
+	codec, _ := parseCodec(config.CacheCodec)
 	var rdb *redis.Client
 	if config.RedisAddr != "" {
 		redisOpts := redis.Options{
@@ -465,6 +586,22 @@ func initCaches(config config, logger *zap.Logger) {
 		logger.Info("Connection to Redis established!")
 	}
 
+	var mc *memcache.Client
+	if config.RedisAddr == "" && config.MemcachedAddrs != "" {
+		selector, err := newConsistentSelector(strings.Split(config.MemcachedAddrs, ",")...)
+		if err != nil {
+			logger.Fatal("Couldn't resolve memcached server addresses", zap.Error(err))
+		}
+		mc = memcache.NewFromSelector(selector)
+		// Unlike Redis, the connection isn't tested, because unreachable servers only lead to cache misses
+	}
+
+	rdAvailabilityCache = initCreationCache(config, rdb, mc, "availability-rd", "RD availability cache", config.CacheAgeXD, 24*time.Hour, false, logger)
+	adAvailabilityCache = initCreationCache(config, rdb, mc, "availability-ad", "AD availability cache", config.CacheAgeXD, 24*time.Hour, false, logger)
+	pmAvailabilityCache = initCreationCache(config, rdb, mc, "availability-pm", "Premiumize availability cache", config.CacheAgeXD, 24*time.Hour, false, logger)
+	unavailableCache = initCreationCache(config, rdb, mc, "unavailable", "unavailability cache", config.CacheAgeUnavailXD, 10*time.Minute, false, logger)
+	tokenCache = initCreationCache(config, rdb, mc, "token", "token cache", config.CacheAgeTokens, 24*time.Hour, true, logger)
+
 	if config.RedisAddr == "" {
 		if redirectCacheItems, err := loadGoCache(config.CachePath + "/redirect.gob"); err != nil {
 			logger.Error("Couldn't load redirect cache from file - continuing with an empty cache", zap.Error(err))
@@ -479,9 +616,14 @@ func initCaches(config config, logger *zap.Logger) {
 	} else {
 		var t []imdb2torrent.Result
 		redirectCache = &goCache{
-			rdb:    rdb,
-			t:      reflect.TypeOf(t),
-			logger: logger,
+			rdb:         rdb,
+			t:           reflect.TypeOf(t),
+			logger:      logger,
+			compressMin: config.RedisCompressMin,
+			codec:       codec,
+			prefix:      "redirect:",
+			// Until the entries from before the prefix expired
+			readUnprefixed: true,
 		}
 	}
 
@@ -489,37 +631,100 @@ func initCaches(config config, logger *zap.Logger) {
 		if streamCacheItems, err := loadGoCache(config.CachePath + "/stream.gob"); err != nil {
 			logger.Error("Couldn't load stream cache from file - continuing with an empty cache", zap.Error(err))
 			streamCache = &goCache{
-				cache: gocache.New(streamExpiration, 24*time.Hour),
+				cache: gocache.New(config.CacheAgeStreams, 24*time.Hour),
 			}
 		} else {
 			streamCache = &goCache{
-				cache: gocache.NewFrom(streamExpiration, 24*time.Hour, streamCacheItems),
+				cache: gocache.NewFrom(config.CacheAgeStreams, 24*time.Hour, streamCacheItems),
 			}
 		}
 	} else {
 		var t cacheItem
 		streamCache = &goCache{
-			rdb:    rdb,
-			t:      reflect.TypeOf(t),
-			logger: logger,
+			rdb:         rdb,
+			t:           reflect.TypeOf(t),
+			logger:      logger,
+			compressMin: config.RedisCompressMin,
+			codec:       codec,
+			prefix:      "stream:",
+			// Until the entries from before the prefix expired
+			readUnprefixed: true,
 		}
 	}
 
-	tokenCacheItems, err := loadGoCache(config.CachePath + "/token.gob")
-	if err != nil {
-		logger.Error("Couldn't load token cache from file - continuing with an empty cache", zap.Error(err))
-		tokenCacheItems = map[string]gocache.Item{}
-	}
-	tokenCache = &creationCache{
-		cache: gocache.NewFrom(tokenExpiration, 24*time.Hour, tokenCacheItems),
-	}
-
 	duration := time.Since(start).Milliseconds()
 	durationString := strconv.FormatInt(duration, 10) + "ms"
 	logger.Info("Initialized caches", zap.String("duration", durationString))
 }
 
-func initClients(config config, logger *zap.Logger) {
+// initCreationCache creates a creationCache that uses Redis or memcached if their client isn't nil (with an in-memory cache in front if configured), or BadgerDB if configured, with the name as key prefix.
+// Otherwise it uses go-cache or an LRU cache, filled from the file with the given name.
+func initCreationCache(config config, rdb *redis.Client, mc *memcache.Client, name, description string, expiration, cleanupInterval time.Duration, hashKeys bool, logger *zap.Logger) *creationCache {
+	var local *lruCache
+	if config.LocalCacheEntries > 0 {
+		local = newLRUCache(config.LocalCacheEntries, config.LocalCacheAge, nil)
+	}
+	if rdb != nil {
+		return &creationCache{
+			rdb:        rdb,
+			local:      local,
+			prefix:     name + ":",
+			expiration: expiration,
+			hashKeys:   hashKeys,
+			jitter:     config.CacheJitter,
+		}
+	}
+	if mc != nil {
+		return &creationCache{
+			mc:         mc,
+			local:      local,
+			prefix:     name + ":",
+			expiration: expiration,
+			hashKeys:   hashKeys,
+			jitter:     config.CacheJitter,
+		}
+	}
+	if config.CachesInDB {
+		// The BadgerDB is set in initStores(), because it's opened after the caches are initialized
+		return &creationCache{
+			prefix:     name + "_",
+			expiration: expiration,
+			hashKeys:   hashKeys,
+			jitter:     config.CacheJitter,
+		}
+	}
+	items, err := loadGoCache(config.CachePath + "/" + name + ".gob")
+	if err != nil {
+		logger.Error("Couldn't load "+description+" from file - continuing with an empty cache", zap.Error(err))
+		items = map[string]gocache.Item{}
+	}
+	if hashKeys {
+		items = withHashedKeys(items)
+	}
+	if config.CacheMaxEntries > 0 {
+		c := &creationCache{
+			lru:        newLRUCache(config.CacheMaxEntries, expiration, items),
+			expiration: expiration,
+			hashKeys:   hashKeys,
+			jitter:     config.CacheJitter,
+		}
+		if config.CacheJanitor > 0 {
+			go c.runJanitor(config.CacheJanitor)
+		}
+		return c
+	}
+	if config.CacheJanitor > 0 {
+		cleanupInterval = config.CacheJanitor
+	}
+	return &creationCache{
+		cache:      gocache.NewFrom(expiration, cleanupInterval, items),
+		expiration: expiration,
+		hashKeys:   hashKeys,
+		jitter:     config.CacheJitter,
+	}
+}
+
+func initClients(config config, eventBus *events.Bus, logger *zap.Logger) {
 	logger.Info("Initializing clients...")
 	start := time.Now()
 
@@ -551,16 +756,24 @@ func initClients(config config, logger *zap.Logger) {
 		"ibit":  imdb2torrent.NewIbitClient(ibitClientOpts, torrentCache, logger, config.LogFoundTorrents),
 		"RARBG": imdb2torrent.NewRARBGclient(rarbgClientOpts, torrentCache, logger, config.LogFoundTorrents),
 	}
+	for name, siteClient := range siteClients {
+		siteClients[name] = newBackoffSearcher(name, siteClient, timeout, eventBus, logger)
+	}
 	searchClient = imdb2torrent.NewClient(siteClients, timeout, logger)
-	rdClient, err = realdebrid.NewClient(rdClientOpts, tokenCache, rdAvailabilityCache, logger)
+	clientAvailabilityCaches = map[string]*refreshableCache{
+		"rd": newRefreshableCache(rdAvailabilityCache),
+		"ad": newRefreshableCache(adAvailabilityCache),
+		"pm": newRefreshableCache(pmAvailabilityCache),
+	}
+	rdClient, err = realdebrid.NewClient(rdClientOpts, tokenCache, clientAvailabilityCaches["rd"], logger)
 	if err != nil {
 		logger.Fatal("Couldn't create RealDebrid client", zap.Error(err))
 	}
-	adClient, err = alldebrid.NewClient(adClientOpts, tokenCache, adAvailabilityCache, logger)
+	adClient, err = alldebrid.NewClient(adClientOpts, tokenCache, clientAvailabilityCaches["ad"], logger)
 	if err != nil {
 		logger.Fatal("Couldn't create AllDebrid client", zap.Error(err))
 	}
-	pmClient, err = premiumize.NewClient(pmClientOpts, tokenCache, pmAvailabilityCache, logger)
+	pmClient, err = premiumize.NewClient(pmClientOpts, tokenCache, clientAvailabilityCaches["pm"], logger)
 	if err != nil {
 		logger.Fatal("Couldn't create Premiumize client", zap.Error(err))
 	}
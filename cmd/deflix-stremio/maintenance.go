@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/doingodswork/deflix-stremio/pkg/events"
+)
+
+// maintenanceTracker keeps track of debrid services that are under maintenance.
+// During maintenance, RealDebrid (and the other services) respond with "503 Service Unavailable" to all requests,
+// so there's no point in sending further requests for a while.
+type maintenanceTracker struct {
+	cooldown time.Duration
+	// Debrid service ID ("rd", "ad", "pm") -> end of the cooldown
+	until    map[string]time.Time
+	lock     *sync.RWMutex
+	eventBus *events.Bus
+	logger   *zap.Logger
+}
+
+func newMaintenanceTracker(cooldown time.Duration, eventBus *events.Bus, logger *zap.Logger) *maintenanceTracker {
+	return &maintenanceTracker{
+		cooldown: cooldown,
+		until:    map[string]time.Time{},
+		lock:     &sync.RWMutex{},
+		eventBus: eventBus,
+		logger:   logger,
+	}
+}
+
+// report checks if the error from a debrid client indicates maintenance, and if so, starts the cooldown for the debrid service.
+// It returns true if the error indicates maintenance.
+func (t *maintenanceTracker) report(debridID string, err error) bool {
+	if t.cooldown <= 0 || !isMaintenanceErr(err) {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Don't extend the cooldown with every request that was sent before it started
+	if time.Now().Before(t.until[debridID]) {
+		return true
+	}
+	t.until[debridID] = time.Now().Add(t.cooldown)
+	t.logger.Warn("Debrid service seems to be under maintenance, not sending further requests for a while", zap.String("debridService", debridID), zap.Duration("cooldown", t.cooldown), zap.Error(err))
+	t.eventBus.Publish(events.Event{Type: events.ProviderMaintenance, Provider: debridID, Error: err.Error(), Duration: t.cooldown})
+	return true
+}
+
+// active returns true if the debrid service is in its maintenance cooldown.
+func (t *maintenanceTracker) active(debridID string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return time.Now().Before(t.until[debridID])
+}
+
+// isMaintenanceErr returns true if the error is from a "503 Service Unavailable" response.
+// The go-debrid clients don't return typed errors, but include the response status in the message.
+func isMaintenanceErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "503 Service Unavailable")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMaintenanceTracker(t *testing.T) {
+	maintenance := newMaintenanceTracker(time.Minute, nil, zap.NewNop())
+
+	// Other errors don't start the cooldown
+	require.False(t, maintenance.report("rd", errors.New("Invalid token")))
+	require.False(t, maintenance.active("rd"))
+
+	err := errors.New("bad HTTP response status: 503 Service Unavailable (GET request to 'https://api.real-debrid.com/rest/1.0/user')")
+	require.True(t, maintenance.report("rd", err))
+	require.True(t, maintenance.active("rd"))
+	// Only for the reported debrid service
+	require.False(t, maintenance.active("pm"))
+
+	// Disabled
+	maintenance = newMaintenanceTracker(0, nil, zap.NewNop())
+	require.False(t, maintenance.report("rd", err))
+	require.False(t, maintenance.active("rd"))
+}
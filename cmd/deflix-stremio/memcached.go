@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Number of points per server on the hash ring. More points lead to a more even distribution of the keys.
+const memcachedRingPoints = 100
+
+var _ memcache.ServerSelector = (*consistentSelector)(nil)
+
+// consistentSelector picks the memcached server for a key via consistent hashing.
+// Unlike memcache.ServerList, adding or removing a server only moves the keys of one server to another,
+// instead of almost all keys, which would look like a flushed cache.
+type consistentSelector struct {
+	addrs []net.Addr
+	// Sorted hashes of the points on the ring
+	ring []uint32
+	// Point hash -> server
+	owners map[uint32]net.Addr
+}
+
+func newConsistentSelector(servers ...string) (*consistentSelector, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no memcached servers")
+	}
+	s := &consistentSelector{
+		owners: map[uint32]net.Addr{},
+	}
+	for _, server := range servers {
+		addr, err := net.ResolveTCPAddr("tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		s.addrs = append(s.addrs, addr)
+		for i := 0; i < memcachedRingPoints; i++ {
+			// The server string instead of the resolved address, so that the ring doesn't change when the IP changes
+			point := crc32.ChecksumIEEE([]byte(server + "-" + strconv.Itoa(i)))
+			s.owners[point] = addr
+			s.ring = append(s.ring, point)
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i] < s.ring[j] })
+	return s, nil
+}
+
+// PickServer returns the server of the first point on the ring after the key's hash.
+func (s *consistentSelector) PickServer(key string) (net.Addr, error) {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i] >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.owners[s.ring[i]], nil
+}
+
+func (s *consistentSelector) Each(f func(net.Addr) error) error {
+	for _, addr := range s.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memcachedExpiration converts the expiration into memcached's format.
+// memcached interprets values of more than 30 days as absolute Unix time.
+func memcachedExpiration(expiration time.Duration) int32 {
+	if expiration <= 0 {
+		return 0
+	}
+	if expiration > 30*24*time.Hour {
+		return int32(time.Now().Add(expiration).Unix())
+	}
+	return int32(expiration.Seconds())
+}
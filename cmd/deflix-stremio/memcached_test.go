@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsistentSelector(t *testing.T) {
+	_, err := newConsistentSelector()
+	require.Error(t, err)
+
+	before, err := newConsistentSelector("127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211")
+	require.NoError(t, err)
+	after, err := newConsistentSelector("127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211", "127.0.0.4:11211")
+	require.NoError(t, err)
+
+	// Adding a server must only move keys to the new server
+	used := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		key := "rd-availability:" + strconv.Itoa(i)
+		addrBefore, err := before.PickServer(key)
+		require.NoError(t, err)
+		addrAfter, err := after.PickServer(key)
+		require.NoError(t, err)
+		if addrBefore.String() != addrAfter.String() {
+			require.Equal(t, "127.0.0.4:11211", addrAfter.String())
+		}
+		used[addrBefore.String()] = true
+	}
+	require.Len(t, used, 3)
+
+	var addrs []string
+	err = after.Each(func(addr net.Addr) error {
+		addrs = append(addrs, addr.String())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, addrs, 4)
+}
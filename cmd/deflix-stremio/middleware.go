@@ -3,17 +3,21 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
@@ -23,10 +27,16 @@ import (
 )
 
 // createAuthMiddleware creates a middleware that checks the validity of RealDebrid, AllDebrid and Premiumize API tokens/keys as well as Premiumize OAuth2 data.
-func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, useOAUTH2 bool, confRD, confPM oauth2.Config, aesKey []byte, logger *zap.Logger) fiber.Handler {
+// When the validation fails because the debrid service is under maintenance, it responds with "503 Service Unavailable" instead of "403 Forbidden".
+// While the maintenance cooldown is active, no validation is done at all.
+func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, useOAUTH2 bool, confRD, confPM oauth2.Config, aesKey []byte, maintenance *maintenanceTracker, retry *retrier, logger *zap.Logger) fiber.Handler {
 	httpClient := &http.Client{
 		Timeout: 2 * time.Second,
 	}
+	// Access tokens are only valid for a limited time (1h for RealDebrid), so they're shared by all requests of a user until they expire.
+	accessTokenCache := gocache.New(time.Hour, 10*time.Minute)
+	tokenSourceRD := newOAuth2TokenSource(confRD, aesKey, true, httpClient, accessTokenCache, logger)
+	tokenSourcePM := newOAuth2TokenSource(confPM, aesKey, false, nil, accessTokenCache, logger)
 
 	return func(c *fiber.Ctx) error {
 		rCtx := c.Context()
@@ -43,31 +53,59 @@ func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Clien
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
 
+		// During maintenance the debrid service can't validate tokens/keys anyway, and the handlers only serve cached data,
+		// which is user-specific where it matters (the stream URLs).
+		// The key/token isn't used then, and getting an access token for OAUTH2 data would require another request.
+		hasCredentials := userData.RDtoken != "" || userData.RDoauth2 != "" || userData.ADkey != "" || userData.PMkey != "" || userData.PMoauth2 != ""
+		if hasCredentials && maintenance.active(userData.debridID()) {
+			logger.Debug("Debrid service is under maintenance, skipping token/key validation", zap.String("debridService", userData.debridID()))
+			c.Locals("deflix_keyOrToken", "")
+			return c.Next()
+		}
+
 		// Note: Even when useOAUTH2 is true, some Stremio clients might still use the API key from the past.
 		if useOAUTH2 && (userData.RDoauth2 != "" || userData.PMoauth2 != "") {
 			if userData.RDoauth2 != "" {
-				accessToken, err, fiberErr := getAccessTokenForOAuth2data(c, confRD, aesKey, userData.RDoauth2, true, httpClient, logger)
+				accessToken, cached, err, fiberErr := tokenSourceRD.accessToken(c, userData.RDoauth2, false)
 				if err != nil {
 					logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
 					// HTTP responses are already handled
 					return fiberErr
 				}
-				if err = rdClient.TestToken(c.Context(), accessToken); err != nil {
+				if err = retry.do(c.Context(), func() error { return rdClient.TestToken(c.Context(), accessToken) }); err != nil && cached {
+					// The cached access token might have been revoked, so refresh it and try once more
+					logger.Info("Cached access token is invalid or validation failed, refreshing it", zap.Error(err))
+					if accessToken, _, err, fiberErr = tokenSourceRD.accessToken(c, userData.RDoauth2, true); err != nil {
+						logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
+						return fiberErr
+					}
+					err = retry.do(c.Context(), func() error { return rdClient.TestToken(c.Context(), accessToken) })
+				}
+				if err != nil {
 					logger.Info("Access token is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
+					return c.SendStatus(validationErrStatus(maintenance, "rd", err))
 				}
 				c.Locals("deflix_keyOrToken", accessToken)
 			} else if userData.PMoauth2 != "" {
-				accessToken, err, fiberErr := getAccessTokenForOAuth2data(c, confPM, aesKey, userData.PMoauth2, false, nil, logger)
+				accessToken, cached, err, fiberErr := tokenSourcePM.accessToken(c, userData.PMoauth2, false)
 				if err != nil {
 					logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
 					// HTTP responses are already handled
 					return fiberErr
 				}
 				c.Locals("debrid_OAUTH2", struct{}{})
-				if err = pmClient.TestAPIkey(c.Context(), accessToken); err != nil {
+				if err = retry.do(c.Context(), func() error { return pmClient.TestAPIkey(c.Context(), accessToken) }); err != nil && cached {
+					// The cached access token might have been revoked, so refresh it and try once more
+					logger.Info("Cached access token is invalid or validation failed, refreshing it", zap.Error(err))
+					if accessToken, _, err, fiberErr = tokenSourcePM.accessToken(c, userData.PMoauth2, true); err != nil {
+						logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
+						return fiberErr
+					}
+					err = retry.do(c.Context(), func() error { return pmClient.TestAPIkey(c.Context(), accessToken) })
+				}
+				if err != nil {
 					logger.Info("Access token is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
+					return c.SendStatus(validationErrStatus(maintenance, "pm", err))
 				}
 				c.Locals("deflix_keyOrToken", accessToken)
 			}
@@ -78,21 +116,21 @@ func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Clien
 			}
 			// We expect a user to have *either* an RD token *or* an AD key *or* a Premiumize key
 			if userData.RDtoken != "" {
-				if err := rdClient.TestToken(rCtx, userData.RDtoken); err != nil {
+				if err := retry.do(rCtx, func() error { return rdClient.TestToken(rCtx, userData.RDtoken) }); err != nil {
 					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
+					return c.SendStatus(validationErrStatus(maintenance, "rd", err))
 				}
 				c.Locals("deflix_keyOrToken", userData.RDtoken)
 			} else if userData.ADkey != "" {
-				if err := adClient.TestAPIkey(rCtx, userData.ADkey); err != nil {
+				if err := retry.do(rCtx, func() error { return adClient.TestAPIkey(rCtx, userData.ADkey) }); err != nil {
 					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
+					return c.SendStatus(validationErrStatus(maintenance, "ad", err))
 				}
 				c.Locals("deflix_keyOrToken", userData.ADkey)
 			} else if userData.PMkey != "" {
-				if err := pmClient.TestAPIkey(rCtx, userData.PMkey); err != nil {
+				if err := retry.do(rCtx, func() error { return pmClient.TestAPIkey(rCtx, userData.PMkey) }); err != nil {
 					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
+					return c.SendStatus(validationErrStatus(maintenance, "pm", err))
 				}
 				c.Locals("deflix_keyOrToken", userData.PMkey)
 			} else {
@@ -105,25 +143,87 @@ func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Clien
 	}
 }
 
-// getAccessTokenForOAuth2data is a convenience function that decrypts the OAUTH2 data and returns a valid (potentially refreshed) access token,
+// oauth2TokenSource provides access tokens for the encrypted OAUTH2 data from the user data.
+// The OAUTH2 data contains the refresh token, which is used to get a new access token when there's no unexpired one in the cache.
+type oauth2TokenSource struct {
+	conf         oauth2.Config
+	aesKey       []byte
+	rdWorkaround bool
+	httpClient   *http.Client
+	cache        *gocache.Cache
+	logger       *zap.Logger
+}
+
+func newOAuth2TokenSource(conf oauth2.Config, aesKey []byte, rdWorkaround bool, httpClient *http.Client, cache *gocache.Cache, logger *zap.Logger) *oauth2TokenSource {
+	return &oauth2TokenSource{
+		conf:         conf,
+		aesKey:       aesKey,
+		rdWorkaround: rdWorkaround,
+		httpClient:   httpClient,
+		cache:        cache,
+		logger:       logger,
+	}
+}
+
+// accessToken returns a cached access token if there is one that's not expired yet and forceRefresh is false.
+// Otherwise it gets a new one with the refresh token and caches it until shortly before it expires.
+// The bool return value indicates whether the access token came from the cache.
+// The first error return value is the error that occurred inside this method. The second is from sending the response via Fiber.
+func (ts *oauth2TokenSource) accessToken(c *fiber.Ctx, oauth2data string, forceRefresh bool) (string, bool, error, error) {
+	// The OAUTH2 data contains the refresh token, so we don't want it as plain cache key
+	oauth2dataHash := sha256.Sum256([]byte(oauth2data))
+	cacheKey := ts.conf.ClientID + "-" + base64.RawURLEncoding.EncodeToString(oauth2dataHash[:])
+	if !forceRefresh {
+		if accessToken, found := ts.cache.Get(cacheKey); found {
+			return accessToken.(string), true, nil, nil
+		}
+	}
+
+	token, err, fiberErr := getAccessTokenForOAuth2data(c, ts.conf, ts.aesKey, oauth2data, ts.rdWorkaround, ts.httpClient, ts.logger)
+	if err != nil {
+		return "", false, err, fiberErr
+	}
+	// Tokens without expiry aren't cached, because we don't know when they become invalid.
+	// The margin makes sure a cached token doesn't expire between the middleware and the actual debrid request.
+	if !token.Expiry.IsZero() {
+		if ttl := time.Until(token.Expiry) - time.Minute; ttl > 0 {
+			ts.cache.Set(cacheKey, token.AccessToken, ttl)
+		}
+	}
+	return token.AccessToken, false, nil, nil
+}
+
+// validationErrStatus returns the HTTP status for a failed token/key validation.
+func validationErrStatus(maintenance *maintenanceTracker, debridID string, err error) int {
+	if maintenance.report(debridID, err) {
+		return fiber.StatusServiceUnavailable
+	}
+	// The key or token might be valid, but we couldn't check it
+	if isRateLimitErr(err) {
+		return fiber.StatusTooManyRequests
+	}
+	return fiber.StatusForbidden
+}
+
+// getAccessTokenForOAuth2data is a convenience function that decrypts the OAUTH2 data and returns a valid (potentially refreshed) token,
 // while taking care of Fiber responses in error cases.
 // The first error return value is the error that occurred inside this function. The second is from sending the response via Fiber.
-func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte, oauth2data string, rdWorkaround bool, httpClient *http.Client, logger *zap.Logger) (string, error, error) {
+func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte, oauth2data string, rdWorkaround bool, httpClient *http.Client, logger *zap.Logger) (*oauth2.Token, error, error) {
 	ciphertext, err := base64.RawURLEncoding.DecodeString(oauth2data)
 	if err != nil {
 		// It's most likely a client-side encoding error
-		return "", err, c.SendStatus(fiber.StatusBadRequest)
+		return nil, err, c.SendStatus(fiber.StatusBadRequest)
 	}
 
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
 		logger.Warn("Couldn't create block cipher from AES key", zap.Error(err))
-		return "", err, c.SendStatus(fiber.StatusInternalServerError)
+		return nil, err, c.SendStatus(fiber.StatusInternalServerError)
 	}
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		logger.Error("Couldn't create AES GCM", zap.Error(err))
-		return "", err, c.SendStatus(fiber.StatusInternalServerError)
+		return nil, err, c.SendStatus(fiber.StatusInternalServerError)
 	}
 	// The nonce is prepended
 	nonce := ciphertext[:aesgcm.NonceSize()]
@@ -131,16 +231,16 @@ func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte
 
 	tokenJSON, err := aesgcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return "", err, c.SendStatus(fiber.StatusForbidden)
+		return nil, err, c.SendStatus(fiber.StatusForbidden)
 	}
 	token := &oauth2.Token{}
 	if err = json.Unmarshal(tokenJSON, token); err != nil {
 		// How likely is it that if the previous decoding worked, that it's now the client's fault vs ours?
-		return "", err, c.SendStatus(fiber.StatusBadRequest)
+		return nil, err, c.SendStatus(fiber.StatusBadRequest)
 	}
 	// This is a workaround for RD, as they don't seem to implement the OAuth2 flow the way the Go OAuth2 package expects
 	// (for example they require grant_type: "http://oauth.net/grant_type/device/1.0", instead of "refresh_token")
-	var accessToken string
+	var validToken *oauth2.Token
 	if rdWorkaround {
 		// Example call from RD docs:
 		// curl -X POST "https://api.real-debrid.com/oauth/v2/token" -d "client_id=ABCDEFGHIJKLM&client_secret=abcdefghsecret0123456789&code=ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789&grant_type=http://oauth.net/grant_type/device/1.0"
@@ -149,16 +249,16 @@ func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte
 		data.Add("client_secret", conf.ClientSecret)
 		data.Add("code", token.RefreshToken)
 		data.Add("grant_type", "http://oauth.net/grant_type/device/1.0")
-		req, err := http.NewRequest("POST", conf.Endpoint.TokenURL, strings.NewReader(data.Encode()))
+		req, err := http.NewRequestWithContext(c.Context(), "POST", conf.Endpoint.TokenURL, strings.NewReader(data.Encode()))
 		if err != nil {
 			logger.Error("Couldn't create request object for RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return nil, err, c.SendStatus(fiber.StatusInternalServerError)
 		}
 		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
 		res, err := httpClient.Do(req)
 		if err != nil {
 			logger.Warn("Error during request to RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return nil, err, c.SendStatus(fiber.StatusInternalServerError)
 		}
 		defer res.Body.Close()
 		// RD API usually always responds with 200 and a JSON object (even for bad requests / invalid accounts etc),
@@ -169,27 +269,105 @@ func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte
 			var errBody []byte
 			errBody, _ = ioutil.ReadAll(res.Body)
 			logger.Info("RD token refresh response != OK", zap.Int("status", res.StatusCode), zap.ByteString("body", errBody))
-			return "", errors.New("RD response != OK"), c.SendStatus(fiber.StatusForbidden)
+			return nil, errors.New("RD response != OK"), c.SendStatus(fiber.StatusForbidden)
 		}
 		tokenJSON, err = ioutil.ReadAll(res.Body)
 		if err != nil {
 			logger.Warn("Couldn't read response body from RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return nil, err, c.SendStatus(fiber.StatusInternalServerError)
+		}
+		// oauth2.Token doesn't have a JSON field for "expires_in", which is what RD responds with.
+		// The expiry from the OAUTH2 data belongs to the old access token, so it must not be kept.
+		token.Expiry = time.Time{}
+		rdToken := struct {
+			*oauth2.Token
+			ExpiresIn int64 `json:"expires_in"`
+		}{
+			Token: token,
 		}
-		if err = json.Unmarshal(tokenJSON, token); err != nil {
+		if err = json.Unmarshal(tokenJSON, &rdToken); err != nil {
 			logger.Warn("Couldn't unmarshal RD response body into OAuth2 token", zap.Error(err), zap.ByteString("body", tokenJSON))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return nil, err, c.SendStatus(fiber.StatusInternalServerError)
 		}
-		accessToken = token.AccessToken
+		if rdToken.ExpiresIn > 0 {
+			token.Expiry = time.Now().Add(time.Duration(rdToken.ExpiresIn) * time.Second)
+		}
+		validToken = token
 	} else {
 		tokenSource := conf.TokenSource(c.Context(), token)
 		// The token source automatically refreshes the token with the refresh token
-		validToken, err := tokenSource.Token()
+		validToken, err = tokenSource.Token()
 		if err != nil {
-			return "", err, c.SendStatus(fiber.StatusForbidden)
+			return nil, err, c.SendStatus(fiber.StatusForbidden)
+		}
+	}
+
+	return validToken, nil, nil
+}
+
+// stageTimings collects the durations of the stages of handling a single request, like finding torrents and checking their availability.
+// Its methods are safe to call on a nil pointer, which is what handlers get for requests that aren't sampled.
+type stageTimings struct {
+	fields []zap.Field
+	last   time.Time
+}
+
+// track records the time since the previous stage (or the start of the request) as duration of the given stage.
+func (t *stageTimings) track(stage string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.fields = append(t.fields, zap.Duration(stage, now.Sub(t.last)))
+	t.last = now
+}
+
+// createSamplingLogMiddleware creates a middleware that logs the request and response size, duration and timings per stage for a random sample of requests.
+// rate is the fraction of requests to log, for example 0.01 for 1%.
+// Handlers can get the *stageTimings via `c.Locals("deflix_stageTimings")` or `ctx.Value("deflix_stageTimings")`.
+func createSamplingLogMiddleware(rate float64, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if rand.Float64() >= rate {
+			return c.Next()
+		}
+
+		start := time.Now()
+		timings := &stageTimings{
+			last: start,
 		}
-		accessToken = validToken.AccessToken
+		c.Locals("deflix_stageTimings", timings)
+		err := c.Next()
+
+		// Only log the route instead of the path, because the path contains the user data
+		fields := []zap.Field{
+			zap.String("method", c.Method()),
+			zap.String("route", c.Route().Path),
+			zap.Int("status", c.Response().StatusCode()),
+			zap.Int("requestSize", len(c.Request().Body())),
+			zap.Int("responseSize", len(c.Response().Body())),
+			zap.Duration("duration", time.Since(start)),
+			zap.Namespace("stages"),
+		}
+		fields = append(fields, timings.fields...)
+		logger.Info("Sampled request", fields...)
+		return err
 	}
+}
 
-	return accessToken, nil, nil
+// createRateLimitMiddleware creates a middleware that limits the number of requests per minute and client IP address.
+// With forwardOriginIP the service is expected to run behind a reverse proxy, so the IP address is taken from the "X-Forwarded-For" header.
+// The last entry is used, because that's the one the reverse proxy appends. The ones before are sent by the client and can be spoofed.
+func createRateLimitMiddleware(max int, forwardOriginIP bool) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        max,
+		Expiration: time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			if forwardOriginIP {
+				if ips := c.IPs(); len(ips) > 0 {
+					return ips[len(ips)-1]
+				}
+			}
+			return c.IP()
+		},
+	})
 }
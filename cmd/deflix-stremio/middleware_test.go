@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(createRateLimitMiddleware(2, true))
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	request := func(forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		res, err := app.Test(req)
+		require.NoError(t, err)
+		return res.StatusCode
+	}
+
+	require.Equal(t, fiber.StatusOK, request("1.1.1.1, 10.0.0.1"))
+	require.Equal(t, fiber.StatusOK, request("2.2.2.2, 10.0.0.1"))
+	// Changing the entries that the client sends doesn't reset the limit
+	require.Equal(t, fiber.StatusTooManyRequests, request("3.3.3.3, 10.0.0.1"))
+	// The entry that the reverse proxy appends is a different client
+	require.Equal(t, fiber.StatusOK, request("1.1.1.1, 10.0.0.2"))
+}
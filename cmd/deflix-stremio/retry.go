@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retrier retries requests to the debrid services that failed with a transient error, with exponential backoff and jitter.
+// It's only meant for idempotent requests like the token validation.
+// GetStreamURL isn't one of them, because it adds the torrent to the user's account before later steps can fail,
+// and the redirect handler already continues with the next torrent after an error.
+// CheckInstantAvailability can't be retried, because the debrid clients don't return an error for failed checks.
+type retrier struct {
+	// Max number of retries after the first attempt
+	maxRetries int
+	// Max wait before the first retry. It's doubled for each further retry.
+	backoff time.Duration
+	// Max duration from the first attempt until the start of the last retry. 0 means no limit.
+	// When the context has an earlier deadline, that's used instead.
+	maxElapsed time.Duration
+	// Optional. Without it, "Retry-After" headers are ignored.
+	retryAfter *retryAfterTracker
+}
+
+// errRateLimited is matched by errors from "429 Too Many Requests" responses (via errors.Is), so that callers can respond accordingly.
+var errRateLimited = errors.New("rate limited by the debrid service")
+
+// rateLimitError is an error from a "429 Too Many Requests" response.
+// It matches errRateLimited, while errors.Is and errors.As still work for the original error.
+type rateLimitError struct {
+	err error
+}
+
+func (e rateLimitError) Error() string {
+	return errRateLimited.Error() + ": " + e.err.Error()
+}
+
+func (e rateLimitError) Unwrap() error {
+	return e.err
+}
+
+func (e rateLimitError) Is(target error) bool {
+	return target == errRateLimited
+}
+
+// do calls f until it succeeds, returns a non-transient error, the retries are used up or the context is done.
+// Rate limiting counts as transient. When the debrid service sent a "Retry-After" header, the wait is at least that long,
+// and when it's longer than the max backoff, the error is returned right away, because the user wouldn't wait that long.
+// No retry is started when the wait would exceed the time budget (see maxElapsed).
+// It returns the last error, wrapped in a rateLimitError if it's from rate limiting.
+// It's safe to call on a nil retrier, which calls f only once.
+func (r *retrier) do(ctx context.Context, f func() error) error {
+	start := time.Now()
+	err := f()
+	if r != nil {
+		err = r.retry(ctx, f, err, start)
+	}
+	if isRateLimitErr(err) && !errors.Is(err, errRateLimited) {
+		return rateLimitError{err: err}
+	}
+	return err
+}
+
+func (r *retrier) retry(ctx context.Context, f func() error, err error, start time.Time) error {
+	for attempt := 0; err != nil && attempt < r.maxRetries && (isTransientErr(err) || isRateLimitErr(err)); attempt++ {
+		// "Full jitter", so that requests that failed at the same time aren't retried at the same time
+		wait := time.Duration(rand.Int63n(int64(r.backoff<<attempt) + 1))
+		if retryAfter := r.retryAfter.wait(err); retryAfter > r.backoff<<(r.maxRetries-1) {
+			return err
+		} else if retryAfter > wait {
+			wait = retryAfter
+		}
+		if deadline, ok := r.deadline(ctx, start); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		err = f()
+	}
+	return err
+}
+
+// deadline returns the time after which no retry is started, which is the earlier one of the context's deadline and the start plus maxElapsed.
+// The bool is false if there's neither.
+func (r *retrier) deadline(ctx context.Context, start time.Time) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if r.maxElapsed > 0 && (!ok || start.Add(r.maxElapsed).Before(deadline)) {
+		return start.Add(r.maxElapsed), true
+	}
+	return deadline, ok
+}
+
+// isRateLimitErr returns true if the error from a debrid client is from a "429 Too Many Requests" response.
+func isRateLimitErr(err error) bool {
+	return err != nil && (errors.Is(err, errRateLimited) || strings.Contains(err.Error(), "429 Too Many Requests"))
+}
+
+// isTransientErr returns true if the error from a debrid client is from a failed connection or a gateway error.
+// Like isMaintenanceErr it has to rely on the message, because the go-debrid clients don't return typed errors.
+// "503 Service Unavailable" isn't included, because that's handled by the maintenance cooldown.
+func isTransientErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Couldn't send GET request") ||
+		strings.Contains(msg, "Couldn't send POST request") ||
+		strings.Contains(msg, "502 Bad Gateway") ||
+		strings.Contains(msg, "504 Gateway Timeout")
+}
+
+// retryAfterTracker records the "Retry-After" header of "429 Too Many Requests" responses per host.
+// The go-debrid clients don't expose response headers, so it's used as HTTP transport to see the responses before the clients do,
+// and the host is later taken from the URL in the client's error message.
+type retryAfterTracker struct {
+	next http.RoundTripper
+	// Host -> time until which no requests should be sent
+	until map[string]time.Time
+	lock  *sync.RWMutex
+}
+
+func newRetryAfterTracker(next http.RoundTripper) *retryAfterTracker {
+	return &retryAfterTracker{
+		next:  next,
+		until: map[string]time.Time{},
+		lock:  &sync.RWMutex{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryAfterTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusTooManyRequests {
+		return res, err
+	}
+	if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+		t.lock.Lock()
+		t.until[req.URL.Host] = time.Now().Add(retryAfter)
+		t.lock.Unlock()
+	}
+	return res, err
+}
+
+// wait returns how long to wait before retrying the request that led to the error, according to the last "Retry-After" header of the host.
+// It returns 0 if there's no such header or the URL isn't part of the error message, and it's safe to call on a nil tracker.
+func (t *retryAfterTracker) wait(err error) time.Duration {
+	if t == nil {
+		return 0
+	}
+	// The go-debrid clients' errors contain the URL like this: "(GET request to 'https://api.real-debrid.com/rest/1.0/user')"
+	msg := err.Error()
+	start := strings.Index(msg, "request to '")
+	if start == -1 {
+		return 0
+	}
+	msg = msg[start+len("request to '"):]
+	end := strings.Index(msg, "'")
+	if end == -1 {
+		return 0
+	}
+	u, parseErr := url.Parse(msg[:end])
+	if parseErr != nil {
+		return 0
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if wait := time.Until(t.until[u.Host]); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// parseRetryAfter parses the value of a "Retry-After" header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(val string, now time.Time) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(val)
+	if err != nil {
+		return 0, false
+	}
+	return date.Sub(now), true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrier(t *testing.T) {
+	transientErr := errors.New("Couldn't fetch user info from real-debrid.com with the provided token: bad HTTP response status: 502 Bad Gateway (GET request to 'https://api.real-debrid.com/rest/1.0/user')")
+	invalidErr := errors.New("Couldn't fetch user info from real-debrid.com with the provided token: Invalid token")
+	r := &retrier{maxRetries: 2, backoff: time.Millisecond}
+
+	// Succeeds on the last retry
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return transientErr
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// Retries are used up
+	calls = 0
+	err = r.do(context.Background(), func() error {
+		calls++
+		return transientErr
+	})
+	require.Equal(t, transientErr, err)
+	require.Equal(t, 3, calls)
+
+	// No retries for other errors
+	calls = 0
+	err = r.do(context.Background(), func() error {
+		calls++
+		return invalidErr
+	})
+	require.Equal(t, invalidErr, err)
+	require.Equal(t, 1, calls)
+
+	// No retries after the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	r.backoff = time.Hour
+	err = r.do(ctx, func() error {
+		calls++
+		return transientErr
+	})
+	require.Equal(t, transientErr, err)
+	require.Equal(t, 1, calls)
+
+	// A nil retrier only calls once
+	var nilRetrier *retrier
+	calls = 0
+	_ = nilRetrier.do(context.Background(), func() error {
+		calls++
+		return transientErr
+	})
+	require.Equal(t, 1, calls)
+}
+
+func TestRetrierRateLimit(t *testing.T) {
+	rateLimitErr := errors.New("Couldn't fetch user info from real-debrid.com with the provided token: bad HTTP response status: 429 Too Many Requests (GET request to 'https://api.real-debrid.com/rest/1.0/user')")
+	r := &retrier{maxRetries: 1, backoff: time.Millisecond}
+
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		return rateLimitErr
+	})
+	require.Equal(t, 2, calls)
+	require.True(t, errors.Is(err, errRateLimited))
+	require.Contains(t, err.Error(), "429 Too Many Requests")
+
+	// Also without retries
+	var nilRetrier *retrier
+	err = nilRetrier.do(context.Background(), func() error {
+		return rateLimitErr
+	})
+	require.True(t, errors.Is(err, errRateLimited))
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+	tracker := newRetryAfterTracker(http.DefaultTransport)
+	client := &http.Client{Transport: tracker}
+	res, err := client.Get(s.URL + "/rest/1.0/user")
+	require.NoError(t, err)
+	res.Body.Close()
+
+	rateLimitErr := errors.New("bad HTTP response status: 429 Too Many Requests (GET request to '" + s.URL + "/rest/1.0/user')")
+	require.InDelta(t, time.Second, tracker.wait(rateLimitErr), float64(100*time.Millisecond))
+	require.Zero(t, tracker.wait(errors.New("Couldn't send GET request")))
+	var nilTracker *retryAfterTracker
+	require.Zero(t, nilTracker.wait(rateLimitErr))
+
+	// Longer than the max backoff, so there's no retry
+	r := &retrier{maxRetries: 2, backoff: time.Millisecond, retryAfter: tracker}
+	calls := 0
+	err = r.do(context.Background(), func() error {
+		calls++
+		return rateLimitErr
+	})
+	require.Equal(t, 1, calls)
+	require.True(t, errors.Is(err, errRateLimited))
+	require.True(t, errors.Is(err, rateLimitErr))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 2, 1, 12, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("120", now)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, d)
+	d, ok = parseRetryAfter("Mon, 01 Feb 2021 12:00:30 GMT", now)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, d)
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+}
+
+func TestRetrierMaxElapsed(t *testing.T) {
+	transientErr := errors.New("Couldn't send GET request")
+	r := &retrier{maxRetries: 5, backoff: 20 * time.Millisecond, maxElapsed: 50 * time.Millisecond}
+
+	start := time.Now()
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		return transientErr
+	})
+	require.Equal(t, transientErr, err)
+	require.Less(t, calls, 6)
+	require.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// An earlier deadline of the context takes precedence
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	r = &retrier{maxRetries: 5, backoff: time.Second, maxElapsed: time.Hour}
+	start = time.Now()
+	calls = 0
+	err = r.do(ctx, func() error {
+		calls++
+		return transientErr
+	})
+	require.Equal(t, transientErr, err)
+	require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	deadline, ok := (&retrier{}).deadline(context.Background(), start)
+	require.False(t, ok)
+	require.True(t, deadline.IsZero())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/events"
+)
+
+const (
+	// Number of consecutive failures after which a torrent site is disabled
+	scraperFailureThreshold = 3
+	// Duration for which a torrent site is disabled the first time. It doubles with each failed recovery probe.
+	scraperMinBackoff = time.Minute
+	scraperMaxBackoff = 30 * time.Minute
+)
+
+var errScraperDisabled = errors.New("torrent site is temporarily disabled because of repeated failures")
+
+var _ imdb2torrent.MagnetSearcher = (*backoffSearcher)(nil)
+
+// backoffSearcher wraps a torrent site client and stops searching on the site after repeated failures or timeouts,
+// so that a site that's down doesn't slow down every single stream request.
+// After the backoff duration a single search is let through as recovery probe.
+// If it fails, the site is disabled again for twice the duration.
+type backoffSearcher struct {
+	name     string
+	searcher imdb2torrent.MagnetSearcher
+	// Searches that take longer count as failure, because the imdb2torrent client doesn't wait for them anyway
+	timeout  time.Duration
+	eventBus *events.Bus
+	logger   *zap.Logger
+
+	lock          *sync.Mutex
+	failures      int
+	backoff       time.Duration
+	disabledUntil time.Time
+	probing       bool
+	// For tests
+	now func() time.Time
+}
+
+func newBackoffSearcher(name string, searcher imdb2torrent.MagnetSearcher, timeout time.Duration, eventBus *events.Bus, logger *zap.Logger) *backoffSearcher {
+	return &backoffSearcher{
+		name:     name,
+		searcher: searcher,
+		timeout:  timeout,
+		eventBus: eventBus,
+		logger:   logger,
+		lock:     &sync.Mutex{},
+		now:      time.Now,
+	}
+}
+
+// FindMovie implements the imdb2torrent.MagnetSearcher interface.
+func (s *backoffSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	return s.find(func() ([]imdb2torrent.Result, error) {
+		return s.searcher.FindMovie(ctx, imdbID)
+	})
+}
+
+// FindTVShow implements the imdb2torrent.MagnetSearcher interface.
+func (s *backoffSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	return s.find(func() ([]imdb2torrent.Result, error) {
+		return s.searcher.FindTVShow(ctx, imdbID, season, episode)
+	})
+}
+
+// IsSlow implements the imdb2torrent.MagnetSearcher interface.
+func (s *backoffSearcher) IsSlow() bool {
+	return s.searcher.IsSlow()
+}
+
+func (s *backoffSearcher) find(find func() ([]imdb2torrent.Result, error)) ([]imdb2torrent.Result, error) {
+	s.lock.Lock()
+	isProbe := false
+	if !s.disabledUntil.IsZero() {
+		// Only one request at a time may probe the site, all others are skipped until the probe is finished
+		if s.probing || s.now().Before(s.disabledUntil) {
+			s.lock.Unlock()
+			return nil, errScraperDisabled
+		}
+		s.probing = true
+		isProbe = true
+	}
+	s.lock.Unlock()
+
+	start := s.now()
+	results, err := find()
+	failure := err
+	// Slow sites have a shorter timeout in the imdb2torrent client, but are expected to be slow, so we don't count it as failure for them
+	if err == nil && !s.searcher.IsSlow() && s.now().Sub(start) > s.timeout {
+		failure = errors.New("search took longer than the timeout")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if isProbe {
+		s.probing = false
+	}
+	if failure == nil {
+		if !s.disabledUntil.IsZero() {
+			s.logger.Info("Torrent site recovered", zap.String("torrentSite", s.name))
+			s.eventBus.Publish(events.Event{Type: events.ScraperRecovered, Scraper: s.name})
+		}
+		s.failures = 0
+		s.backoff = 0
+		s.disabledUntil = time.Time{}
+		return results, nil
+	}
+
+	s.failures++
+	if isProbe || s.failures == scraperFailureThreshold {
+		if s.backoff == 0 {
+			s.backoff = scraperMinBackoff
+		} else {
+			s.backoff *= 2
+		}
+		if s.backoff > scraperMaxBackoff {
+			s.backoff = scraperMaxBackoff
+		}
+		s.disabledUntil = s.now().Add(s.backoff)
+		s.eventBus.Publish(events.Event{Type: events.ScraperDisabled, Scraper: s.name, Error: failure.Error(), Duration: s.backoff})
+	}
+	return results, err
+}
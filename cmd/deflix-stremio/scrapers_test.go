@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+type fakeSearcher struct {
+	err   error
+	calls int
+}
+
+func (s *fakeSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []imdb2torrent.Result{{InfoHash: "A1"}}, nil
+}
+
+func (s *fakeSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	return s.FindMovie(ctx, imdbID)
+}
+
+func (s *fakeSearcher) IsSlow() bool {
+	return false
+}
+
+func TestBackoffSearcher(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	site := &fakeSearcher{err: errors.New("site down")}
+	// A nil event bus is fine, publishing is a no-op then
+	s := newBackoffSearcher("foo", site, time.Second, nil, zap.NewNop())
+	s.now = func() time.Time { return now }
+
+	// Below the threshold the site is still searched
+	for i := 0; i < scraperFailureThreshold; i++ {
+		_, err := s.FindMovie(ctx, "tt123")
+		require.Equal(t, site.err, err)
+	}
+	require.Equal(t, scraperFailureThreshold, site.calls)
+
+	// Now it's disabled
+	_, err := s.FindMovie(ctx, "tt123")
+	require.Equal(t, errScraperDisabled, err)
+	require.Equal(t, scraperFailureThreshold, site.calls)
+
+	// A failed probe doubles the backoff
+	now = now.Add(scraperMinBackoff)
+	_, err = s.FindMovie(ctx, "tt123")
+	require.Equal(t, site.err, err)
+	require.Equal(t, scraperFailureThreshold+1, site.calls)
+	now = now.Add(scraperMinBackoff)
+	_, err = s.FindMovie(ctx, "tt123")
+	require.Equal(t, errScraperDisabled, err)
+
+	// A successful probe enables the site again
+	now = now.Add(scraperMinBackoff)
+	site.err = nil
+	results, err := s.FindMovie(ctx, "tt123")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, 0, s.failures)
+	require.True(t, s.disabledUntil.IsZero())
+
+	// Searches that take longer than the timeout count as failures, but their results are still returned
+	slowSite := &fakeSearcher{}
+	s = newBackoffSearcher("bar", slowSite, time.Second, nil, zap.NewNop())
+	calls := 0
+	s.now = func() time.Time {
+		calls++
+		return now.Add(time.Duration(calls) * 2 * time.Second)
+	}
+	results, err = s.FindMovie(ctx, "tt123")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, 1, s.failures)
+}
@@ -3,16 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/dgraph-io/badger/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/klauspost/compress/zstd"
 	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 
@@ -43,6 +50,7 @@ var _ imdb2torrent.Cache = (*resultStore)(nil)
 type resultStore struct {
 	db        *badger.DB
 	keyPrefix string
+	codec     codec
 }
 
 // Set implements the imdb2torrent.Cache interface.
@@ -51,13 +59,13 @@ func (c *resultStore) Set(key string, results []imdb2torrent.Result) error {
 		Results: results,
 		Created: time.Now(),
 	}
-	return gobSet(c.db, c.keyPrefix+key, item)
+	return storeSet(c.db, c.codec, c.keyPrefix+key, item)
 }
 
 // Get implements the imdb2torrent.Cache interface.
 func (c *resultStore) Get(key string) ([]imdb2torrent.Result, time.Time, bool, error) {
 	var item imdb2torrent.CacheItem
-	found, err := gobGet(c.db, c.keyPrefix+key, &item)
+	found, err := storeGet(c.db, c.keyPrefix+key, &item)
 	return item.Results, item.Created, found, err
 }
 
@@ -67,6 +75,7 @@ var _ cinemeta.Cache = (*metaStore)(nil)
 type metaStore struct {
 	db        *badger.DB
 	keyPrefix string
+	codec     codec
 }
 
 // Set implements the cinemeta.Cache interface.
@@ -75,13 +84,13 @@ func (c *metaStore) Set(key string, meta cinemeta.Meta) error {
 		Meta:    meta,
 		Created: time.Now(),
 	}
-	return gobSet(c.db, c.keyPrefix+key, item)
+	return storeSet(c.db, c.codec, c.keyPrefix+key, item)
 }
 
 // Get implements the cinemeta.Cache interface.
 func (c *metaStore) Get(key string) (cinemeta.Meta, time.Time, bool, error) {
 	var item cinemeta.CacheItem
-	found, err := gobGet(c.db, c.keyPrefix+key, &item)
+	found, err := storeGet(c.db, c.keyPrefix+key, &item)
 	if err != nil {
 		return cinemeta.Meta{}, time.Time{}, found, err
 	} else if !found {
@@ -93,19 +102,299 @@ func (c *metaStore) Get(key string) (cinemeta.Meta, time.Time, bool, error) {
 var _ debrid.Cache = (*creationCache)(nil)
 
 // creationCache caches if a key exists and the time this was cached.
+// Like goCache, it uses Redis exclusively if the Redis client is not nil. Otherwise memcached or BadgerDB are used if they're not nil, and an in-memory cache as last option.
 type creationCache struct {
+	// First field, because the 64 bit counters must be 64 bit aligned for atomic access on 32 bit platforms
+	stats cacheStats
 	cache *gocache.Cache
+	// Used instead of go-cache if not nil
+	lru *lruCache
+	rdb *redis.Client
+	mc  *memcache.Client
+	db  *badger.DB
+	// Only used with Redis and memcached, can be nil. Small in-memory cache in front of the remote one, which saves round trips for hot keys.
+	// Its entries expire sooner than the remote ones, so that writes of other instances become visible.
+	local *lruCache
+	// Only used with Redis, memcached and BadgerDB. Prepended to each key, so that the entries of different caches don't mix.
+	prefix string
+	// Expiration of the keys. Redis, memcached and BadgerDB handle it by themselves.
+	expiration time.Duration
+	// Max fraction of the expiration by which the creation time of new entries is moved into the past, chosen randomly per entry.
+	// The callers decide about the expiry based on the creation time, so this spreads the expiry of entries that were written at the same time.
+	jitter float64
+	// Replaces the keys by their hash, for caches whose keys are API keys or tokens.
+	// This way they don't appear in Redis, memcached, BadgerDB or the persisted cache files.
+	hashKeys bool
 }
 
-// Set implements the cinemeta.Cache interface.
+// cacheStats counts the reads and writes of a cache since the service started.
+type cacheStats struct {
+	Hits   int64
+	Misses int64
+	// Reads of entries that were found, but are older than the cache's expiration.
+	// This can happen when the backend didn't remove them yet.
+	Expired     int64
+	WriteErrors int64
+}
+
+// Stats returns a snapshot of the cache's stats.
+func (c *creationCache) Stats() cacheStats {
+	return cacheStats{
+		Hits:        atomic.LoadInt64(&c.stats.Hits),
+		Misses:      atomic.LoadInt64(&c.stats.Misses),
+		Expired:     atomic.LoadInt64(&c.stats.Expired),
+		WriteErrors: atomic.LoadInt64(&c.stats.WriteErrors),
+	}
+}
+
+// Set implements the debrid.Cache interface.
 func (c *creationCache) Set(key string) error {
-	c.cache.Set(key, time.Now(), 0)
-	return nil
+	if c.hashKeys {
+		key = hashKey(key)
+	}
+	err := c.set(key)
+	if err != nil {
+		atomic.AddInt64(&c.stats.WriteErrors, 1)
+	}
+	return err
 }
 
-// Get implements the cinemeta.Cache interface.
+// Get implements the debrid.Cache interface.
+// Errors are counted as misses, because that's how the callers treat them.
 func (c *creationCache) Get(key string) (time.Time, bool, error) {
-	createdIface, found := c.cache.Get(key)
+	if c.hashKeys {
+		key = hashKey(key)
+	}
+	created, found, err := c.get(key)
+	if err != nil || !found {
+		atomic.AddInt64(&c.stats.Misses, 1)
+	} else if c.expiration > 0 && time.Since(created) > c.expiration {
+		atomic.AddInt64(&c.stats.Expired, 1)
+	} else {
+		atomic.AddInt64(&c.stats.Hits, 1)
+	}
+	return created, found, err
+}
+
+// importItems adds the unexpired items that aren't in the in-memory cache yet, for example from a snapshot.
+// It returns the number of added items. It's a no-op for Redis, memcached and BadgerDB.
+func (c *creationCache) importItems(items map[string]gocache.Item) int {
+	if c.rdb != nil || c.mc != nil || c.db != nil {
+		return 0
+	}
+	if c.hashKeys {
+		items = withHashedKeys(items)
+	}
+	added := 0
+	for k, item := range items {
+		if item.Expired() {
+			continue
+		}
+		if c.lru != nil {
+			if _, found := c.lru.Get(k); !found {
+				c.lru.setWithExpiration(k, item.Object, item.Expiration)
+				added++
+			}
+		} else if _, found := c.cache.Get(k); !found {
+			d := gocache.NoExpiration
+			if item.Expiration > 0 {
+				d = time.Until(time.Unix(0, item.Expiration))
+			}
+			c.cache.Set(k, item.Object, d)
+			added++
+		}
+	}
+	return added
+}
+
+// hashedKeyPrefix marks hashed keys, so that persisted items with plain keys can be recognized and migrated.
+const hashedKeyPrefix = "sha256-"
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hashedKeyPrefix + base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// withHashedKeys hashes the keys of persisted items that were written before the cache hashed its keys.
+// Entries in Redis, memcached and BadgerDB aren't migrated. They expire within the cache's expiration, which only leads to a cache miss for each of them.
+func withHashedKeys(items map[string]gocache.Item) map[string]gocache.Item {
+	result := make(map[string]gocache.Item, len(items))
+	for k, item := range items {
+		if !strings.HasPrefix(k, hashedKeyPrefix) {
+			k = hashKey(k)
+		}
+		result[k] = item
+	}
+	return result
+}
+
+// ClearExpired removes expired entries from the in-memory caches, including the local one in front of a remote cache.
+// Redis, memcached and BadgerDB remove expired keys by themselves, so it's a no-op for them.
+func (c *creationCache) ClearExpired() {
+	if c.local != nil {
+		c.local.DeleteExpired()
+	}
+	if c.rdb != nil || c.mc != nil || c.db != nil {
+		return
+	}
+	if c.lru != nil {
+		c.lru.DeleteExpired()
+		return
+	}
+	c.cache.DeleteExpired()
+}
+
+// Flush removes all entries of the cache.
+// With Redis and BadgerDB only the keys with the cache's prefix are removed, so other caches in the same DB are kept.
+// memcached can only flush all keys of all caches, so it's not supported there.
+func (c *creationCache) Flush() error {
+	if c.local != nil {
+		c.local.Flush()
+	}
+	if c.rdb != nil {
+		ctx := context.Background()
+		iter := c.rdb.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+		var keys []string
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) == 1000 {
+				if err := c.rdb.Del(ctx, keys...).Err(); err != nil {
+					return err
+				}
+				keys = keys[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return c.rdb.Del(ctx, keys...).Err()
+		}
+		return nil
+	} else if c.mc != nil {
+		return errors.New("flushing a single cache isn't supported with memcached")
+	} else if c.db != nil {
+		return c.db.DropPrefix([]byte(c.prefix))
+	}
+	if c.lru != nil {
+		c.lru.Flush()
+		return nil
+	}
+	c.cache.Flush()
+	return nil
+}
+
+// runJanitor calls ClearExpired in the given interval. It never returns, like go-cache's janitor, which also runs for the lifetime of the process.
+func (c *creationCache) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		c.ClearExpired()
+	}
+}
+
+func (c *creationCache) set(key string) error {
+	created := time.Now()
+	if c.jitter > 0 && c.expiration > 0 {
+		created = created.Add(-time.Duration(rand.Int63n(int64(c.jitter*float64(c.expiration)) + 1)))
+	}
+	if err := c.setInBackend(key, created); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.Set(key, created)
+	}
+	return nil
+}
+
+func (c *creationCache) get(key string) (time.Time, bool, error) {
+	if c.local == nil {
+		return c.getFromBackend(key)
+	}
+	if created, found := c.local.Get(key); found {
+		return created.(time.Time), true, nil
+	}
+	// Misses aren't kept locally, so that entries written by other instances are found right away
+	created, found, err := c.getFromBackend(key)
+	if err == nil && found {
+		c.local.Set(key, created)
+	}
+	return created, found, err
+}
+
+func (c *creationCache) setInBackend(key string, created time.Time) error {
+	if c.rdb != nil {
+		return c.rdb.Set(context.Background(), c.prefix+key, created.UnixNano(), c.expiration).Err()
+	} else if c.mc != nil {
+		return c.mc.Set(&memcache.Item{
+			Key:        c.prefix + key,
+			Value:      strconv.AppendInt(nil, created.UnixNano(), 10),
+			Expiration: memcachedExpiration(c.expiration),
+		})
+	} else if c.db != nil {
+		entry := badger.NewEntry([]byte(c.prefix+key), strconv.AppendInt(nil, created.UnixNano(), 10))
+		if c.expiration > 0 {
+			entry = entry.WithTTL(c.expiration)
+		}
+		return c.db.Update(func(txn *badger.Txn) error {
+			return txn.SetEntry(entry)
+		})
+	}
+	if c.lru != nil {
+		c.lru.Set(key, created)
+		return nil
+	}
+	c.cache.Set(key, created, 0)
+	return nil
+}
+
+func (c *creationCache) getFromBackend(key string) (time.Time, bool, error) {
+	if c.rdb != nil {
+		created, err := c.rdb.Get(context.Background(), c.prefix+key).Int64()
+		if err == redis.Nil {
+			return time.Time{}, false, nil
+		} else if err != nil {
+			return time.Time{}, false, err
+		}
+		return time.Unix(0, created), true, nil
+	} else if c.mc != nil {
+		// Other errors (like an unreachable server) are returned, and the callers treat them as cache misses
+		item, err := c.mc.Get(c.prefix + key)
+		if err == memcache.ErrCacheMiss {
+			return time.Time{}, false, nil
+		} else if err != nil {
+			return time.Time{}, false, err
+		}
+		created, err := strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return time.Unix(0, created), true, nil
+	} else if c.db != nil {
+		var created int64
+		err := c.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(c.prefix + key))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				created, err = strconv.ParseInt(string(val), 10, 64)
+				return err
+			})
+		})
+		if err == badger.ErrKeyNotFound {
+			return time.Time{}, false, nil
+		} else if err != nil {
+			return time.Time{}, false, err
+		}
+		return time.Unix(0, created), true, nil
+	}
+	var createdIface interface{}
+	var found bool
+	if c.lru != nil {
+		createdIface, found = c.lru.Get(key)
+	} else {
+		createdIface, found = c.cache.Get(key)
+	}
 	if !found {
 		return time.Time{}, found, nil
 	}
@@ -116,6 +405,18 @@ func (c *creationCache) Get(key string) (time.Time, bool, error) {
 	return created, found, nil
 }
 
+// zstdMagic is the magic number at the beginning of each zstd frame.
+// A gob stream can't start with it, so it's used to detect compressed values in Redis.
+// This way values that were stored before compression was enabled (or below the threshold) can still be read.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// The zstd encoder and decoder are safe for concurrent use when using EncodeAll() and DecodeAll().
+// Errors only occur for invalid options, so they can be ignored.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
 var _ goCacher = (*goCache)(nil)
 
 // goCache wraps both a go-cache instance and Redis and offers methods with the exact same signature as go-cache.
@@ -129,14 +430,37 @@ type goCache struct {
 	t reflect.Type
 	// Only required when using Redis.
 	logger *zap.Logger
+	// Only used with Redis. Encoded values with at least this many bytes are compressed with zstd. 0 disables compression.
+	compressMin int
+	// Only used with Redis. Nil leads to gob.
+	codec codec
+	// Only used with Redis. Prepended to all keys, so that multiple caches can share the same Redis DB without key collisions.
+	prefix string
+	// Only used with Redis. When a key isn't found with the prefix, it's read without it as well.
+	// Entries were written without prefix before, and this keeps them usable until they expire. New entries are only written with the prefix.
+	readUnprefixed bool
 }
 
 func (c *goCache) Set(k string, v interface{}, d time.Duration) {
 	if c.rdb != nil {
-		// Note: We can only decode into a pointer. And when working with interfaces gob requires to encode a pointer.
-		if b, err := toGob(&v); err != nil {
-			c.logger.Error("Couldn't encode value as gob", zap.Error(err))
-		} else if err := c.rdb.Set(context.Background(), k, b, d).Err(); err != nil {
+		var b []byte
+		var err error
+		if c.codec == nil || c.codec.id() == 0 {
+			// Note: We can only decode into a pointer. And when working with interfaces gob requires to encode a pointer.
+			if b, err = toGob(&v); err == nil {
+				b = withFormatVersion(0, b)
+			}
+		} else {
+			b, err = encode(c.codec, v)
+		}
+		if err != nil {
+			c.logger.Error("Couldn't encode value", zap.Error(err))
+			return
+		}
+		if c.compressMin > 0 && len(b) >= c.compressMin {
+			b = zstdEncoder.EncodeAll(b, make([]byte, 0, len(b)))
+		}
+		if err := c.rdb.Set(context.Background(), c.prefix+k, b, d).Err(); err != nil {
 			c.logger.Error("Couldn't set value in Redis", zap.Error(err))
 		}
 	} else {
@@ -146,18 +470,43 @@ func (c *goCache) Set(k string, v interface{}, d time.Duration) {
 
 func (c *goCache) Get(k string) (interface{}, bool) {
 	if c.rdb != nil {
-		if v, err := c.rdb.Get(context.Background(), k).Result(); err != nil && err != redis.Nil {
+		v, err := c.rdb.Get(context.Background(), c.prefix+k).Result()
+		if err == redis.Nil && c.prefix != "" && c.readUnprefixed {
+			v, err = c.rdb.Get(context.Background(), k).Result()
+		}
+		if err != nil && err != redis.Nil {
 			// Note: We only log this when there's an error *and* it's not `redis.Nil` (which just indicates that the value was not found).
 			c.logger.Error("Couldn't get value from Redis", zap.Error(err))
 			// Note: Don't return `nil, true` here, although that would be more correct. But given that the implementation is meant to have the same behavior as go-cache, where there are never encoding errors, a `nil, true` would lead to a caller assuming they can work with the value, but it's nil.
 		} else if err != redis.Nil {
+			b := []byte(v)
+			if bytes.HasPrefix(b, zstdMagic) {
+				if b, err = zstdDecoder.DecodeAll(b, nil); err != nil {
+					c.logger.Error("Couldn't decompress value from Redis", zap.Error(err))
+					return nil, false
+				}
+			}
+			if b, err = withoutFormatVersion(b); err != nil {
+				// Written before or by a newer version of the cached type (for example by another instance during a rolling update), so it's just a cache miss
+				c.logger.Debug("Ignoring value with different format version from Redis", zap.String("key", k))
+				return nil, false
+			}
+			// Values encoded with other codecs than gob are decoded into the concrete type
+			if valCodec, val := codecFor(b); valCodec.id() != 0 {
+				ptr := reflect.New(c.t)
+				if err := valCodec.unmarshal(val, ptr.Interface()); err != nil {
+					c.logger.Error("Couldn't decode value from Redis", zap.Error(err))
+					return nil, false
+				}
+				return ptr.Elem().Interface(), true
+			}
 			var vi interface{}
 			if c.t.Kind() == reflect.Slice {
 				vi = reflect.MakeSlice(c.t, 0, 0)
 			} else {
 				vi = reflect.New(c.t)
 			}
-			if err := fromGob([]byte(v), &vi); err != nil {
+			if err := fromGob(b, &vi); err != nil {
 				c.logger.Error("Couldn't decode gob", zap.Error(err))
 			} else {
 				return vi, true
@@ -188,8 +537,11 @@ func fromGob(b []byte, v interface{}) error {
 	return nil
 }
 
-func gobSet(db *badger.DB, key string, item interface{}) error {
-	b, err := toGob(item)
+func storeSet(db *badger.DB, c codec, key string, item interface{}) error {
+	if c == nil {
+		c = gobCodec{}
+	}
+	b, err := encode(c, item)
 	if err != nil {
 		return fmt.Errorf("Couldn't encode item: %v", err)
 	}
@@ -198,18 +550,18 @@ func gobSet(db *badger.DB, key string, item interface{}) error {
 	})
 }
 
-func gobGet(db *badger.DB, key string, target interface{}) (bool, error) {
+func storeGet(db *badger.DB, key string, target interface{}) (bool, error) {
 	err := db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
 		}
-		item.Value(func(val []byte) error {
-			return fromGob(val, target)
+		return item.Value(func(val []byte) error {
+			return decode(val, target)
 		})
-		return nil
 	})
-	if err == badger.ErrKeyNotFound {
+	// Values with another format version are treated like missing ones, so they get overwritten
+	if err == badger.ErrKeyNotFound || err == errFormatVersion {
 		return false, nil
 	} else if err != nil {
 		return true, err
@@ -222,6 +574,7 @@ func saveGoCache(items map[string]gocache.Item, filePath string) error {
 	if err != nil {
 		return fmt.Errorf("Couldn't create go-cache file: %v", err)
 	}
+	defer file.Close()
 	encoder := gob.NewEncoder(file)
 	if err = encoder.Encode(items); err != nil {
 		return fmt.Errorf("Couldn't encode items for go-cache file: %v", err)
@@ -234,6 +587,7 @@ func loadGoCache(filePath string) (map[string]gocache.Item, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't open go-cache file: %v", err)
 	}
+	defer file.Close()
 	decoder := gob.NewDecoder(file)
 	result := map[string]gocache.Item{}
 	if err = decoder.Decode(&result); err != nil {
@@ -242,7 +596,46 @@ func loadGoCache(filePath string) (map[string]gocache.Item, error) {
 	return result, nil
 }
 
-func persistCaches(ctx context.Context, cacheFilePath string, goCaches map[string]*gocache.Cache, logger *zap.Logger) {
+// saveSnapshot writes the items of all given caches into a single file, so they can be moved to another instance and loaded with loadSnapshot.
+func saveSnapshot(caches map[string]persistableCache, filePath string) error {
+	snapshot := make(map[string]map[string]gocache.Item, len(caches))
+	for name, c := range caches {
+		snapshot[name] = c.Items()
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Couldn't create snapshot file: %v", err)
+	}
+	defer file.Close()
+	encoder := gob.NewEncoder(file)
+	if err = encoder.Encode(snapshot); err != nil {
+		return fmt.Errorf("Couldn't encode items for snapshot file: %v", err)
+	}
+	return nil
+}
+
+// loadSnapshot reads a file that was written by saveSnapshot. It returns the items per cache name.
+func loadSnapshot(filePath string) (map[string]map[string]gocache.Item, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := gob.NewDecoder(file)
+	result := map[string]map[string]gocache.Item{}
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("Couldn't decode items from snapshot file: %v", err)
+	}
+	return result, nil
+}
+
+// persistableCache is implemented by go-cache and lruCache, so both can be persisted to files and show up in the cache stats.
+type persistableCache interface {
+	Items() map[string]gocache.Item
+	ItemCount() int
+}
+
+func persistCaches(ctx context.Context, cacheFilePath string, goCaches map[string]persistableCache, logger *zap.Logger) {
 	// TODO: We might want to overthink this - persisting caches on shutdown might be useful, especially for the redirect cache!
 	if ctx.Err() != nil {
 		logger.Warn("Regular cache persistence triggered, but server is shutting down")
@@ -278,8 +671,12 @@ func persistCaches(ctx context.Context, cacheFilePath string, goCaches map[strin
 	logger.Info("Persisted caches", zap.String("duration", durationString))
 }
 
-func logCacheStats(goCaches map[string]*gocache.Cache, logger *zap.Logger) {
+func logCacheStats(goCaches map[string]persistableCache, creationCaches map[string]*creationCache, logger *zap.Logger) {
 	for name, goCache := range goCaches {
 		logger.Info("Cache stats", zap.String("cache", name), zap.Int("itemCount", goCache.ItemCount()))
 	}
+	for name, c := range creationCaches {
+		stats := c.Stats()
+		logger.Info("Cache usage stats", zap.String("cache", name), zap.Int64("hits", stats.Hits), zap.Int64("misses", stats.Misses), zap.Int64("expired", stats.Expired), zap.Int64("writeErrors", stats.WriteErrors))
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"math"
 	"math/rand"
 	"os"
@@ -9,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
 	gocache "github.com/patrickmn/go-cache"
@@ -71,6 +74,33 @@ func TestGoCachePersistence(t *testing.T) {
 	require.True(t, equal)
 }
 
+func TestCacheSnapshot(t *testing.T) {
+	registerTypes()
+
+	availabilityCache := &creationCache{cache: gocache.New(time.Hour, 0), expiration: time.Hour}
+	tokenCache := &creationCache{lru: newLRUCache(10, time.Hour, nil), expiration: time.Hour, hashKeys: true}
+	require.NoError(t, availabilityCache.Set("A1"))
+	require.NoError(t, tokenCache.Set("secret-token"))
+	filePath := os.TempDir() + "/deflix-snapshot.gob"
+	defer os.Remove(filePath)
+	err := saveSnapshot(map[string]persistableCache{"availability-rd": availabilityCache.cache, "token": tokenCache.lru}, filePath)
+	require.NoError(t, err)
+
+	snapshot, err := loadSnapshot(filePath)
+	require.NoError(t, err)
+	// Existing entries are kept
+	availabilityCache = &creationCache{cache: gocache.New(time.Hour, 0), expiration: time.Hour}
+	require.NoError(t, availabilityCache.Set("A1"))
+	require.NoError(t, availabilityCache.Set("A2"))
+	require.Equal(t, 0, availabilityCache.importItems(snapshot["availability-rd"]))
+	require.Equal(t, 2, availabilityCache.cache.ItemCount())
+	tokenCache = &creationCache{lru: newLRUCache(10, time.Hour, nil), expiration: time.Hour, hashKeys: true}
+	require.Equal(t, 1, tokenCache.importItems(snapshot["token"]))
+	_, found, err := tokenCache.Get("secret-token")
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
 func TestRedis(t *testing.T) {
 	// Doesn't work on Windows: https://github.com/testcontainers/testcontainers-go/issues/152
 	// ip, port, deferFunc := startRedis(t)
@@ -135,6 +165,162 @@ func TestRedis(t *testing.T) {
 	require.Equal(t, v2, res)
 }
 
+func TestRedisCompression(t *testing.T) {
+	ip, port := "localhost", "6379"
+
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: ip + ":" + port,
+	})
+	var type1 []imdb2torrent.Result
+	gc := goCache{
+		rdb:         rdb,
+		t:           reflect.TypeOf(type1),
+		logger:      logger,
+		compressMin: 1,
+	}
+	v := []imdb2torrent.Result{
+		{
+			InfoHash:  "123",
+			MagnetURL: "magnet:?xt=urn:btih:123",
+			Title:     "foo",
+			Quality:   "720p",
+		},
+	}
+
+	// Compressed value
+	k1 := strconv.Itoa(rand.Intn(math.MaxUint32))
+	gc.Set(k1, v, time.Minute)
+	raw, err := rdb.Get(context.Background(), k1).Bytes()
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(raw, zstdMagic))
+	res, found := gc.Get(k1)
+	require.True(t, found)
+	require.Equal(t, v, res)
+
+	// Uncompressed value, for example from before compression was enabled
+	gc.compressMin = 0
+	k2 := strconv.Itoa(rand.Intn(math.MaxUint32))
+	gc.Set(k2, v, time.Minute)
+	raw, err = rdb.Get(context.Background(), k2).Bytes()
+	require.NoError(t, err)
+	require.False(t, bytes.HasPrefix(raw, zstdMagic))
+	gc.compressMin = 1
+	res, found = gc.Get(k2)
+	require.True(t, found)
+	require.Equal(t, v, res)
+}
+
+func TestRedisPrefix(t *testing.T) {
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	var type1 []imdb2torrent.Result
+	redirectCache := goCache{
+		rdb:    rdb,
+		t:      reflect.TypeOf(type1),
+		logger: logger,
+		prefix: "redirect:",
+	}
+	var type2 cacheItem
+	streamCache := goCache{
+		rdb:    rdb,
+		t:      reflect.TypeOf(type2),
+		logger: logger,
+		prefix: "stream:",
+	}
+
+	// Same key in both caches
+	k := strconv.Itoa(rand.Intn(math.MaxUint32))
+	v1 := []imdb2torrent.Result{{InfoHash: "123", Title: "foo"}}
+	v2 := cacheItem{Value: "http://example.com/foo.mkv", Created: time.Now().Truncate(time.Second)}
+	redirectCache.Set(k, v1, time.Minute)
+	streamCache.Set(k, v2, time.Minute)
+
+	res, found := redirectCache.Get(k)
+	require.True(t, found)
+	require.Equal(t, v1, res)
+	res, found = streamCache.Get(k)
+	require.True(t, found)
+	require.Equal(t, v2.Value, res.(cacheItem).Value)
+	exists, err := rdb.Exists(context.Background(), "redirect:"+k, "stream:"+k).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), exists)
+}
+
+func TestRedisUnprefixedFallback(t *testing.T) {
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	var typ cacheItem
+	oldCache := goCache{
+		rdb:    rdb,
+		t:      reflect.TypeOf(typ),
+		logger: logger,
+	}
+	newCache := goCache{
+		rdb:            rdb,
+		t:              reflect.TypeOf(typ),
+		logger:         logger,
+		prefix:         "stream:",
+		readUnprefixed: true,
+	}
+
+	// Written before the prefix was introduced
+	k := strconv.Itoa(rand.Intn(math.MaxUint32))
+	v := cacheItem{Value: "http://example.com/foo.mkv", Created: time.Now().Truncate(time.Second)}
+	oldCache.Set(k, v, time.Minute)
+	res, found := newCache.Get(k)
+	require.True(t, found)
+	require.Equal(t, v.Value, res.(cacheItem).Value)
+	// Not without the option
+	newCache.readUnprefixed = false
+	_, found = newCache.Get(k)
+	require.False(t, found)
+}
+
+func TestRedisCodecs(t *testing.T) {
+	ip, port := "localhost", "6379"
+
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	var type1 cacheItem
+	gc := goCache{
+		rdb: redis.NewClient(&redis.Options{
+			Addr: ip + ":" + port,
+		}),
+		t:      reflect.TypeOf(type1),
+		logger: logger,
+	}
+	v := cacheItem{
+		Value:   "foo",
+		Created: time.Now().Truncate(0), // Truncate to strip monotonic clock, which doesn't get included when encoding/decoding
+	}
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			gc.codec = c
+			k := strconv.Itoa(rand.Intn(math.MaxUint32))
+			gc.Set(k, v, time.Minute)
+			// Values must still be readable after switching the codec
+			for _, otherCodec := range codecs {
+				gc.codec = otherCodec
+				res, found := gc.Get(k)
+				require.True(t, found)
+				require.True(t, cmp.Equal(v, res))
+			}
+		})
+	}
+}
+
 // Doesn't work on Windows in v0.9.0: https://github.com/testcontainers/testcontainers-go/issues/152
 // We need to comment out the function to not have the dependency in the go.mod, which leads to compile errors due to the linked bug.
 // func startRedis(t *testing.T) (string, string, func()) {
@@ -164,3 +350,202 @@ func TestRedis(t *testing.T) {
 
 // 	return ip, port.Port(), func() { redisC.Terminate(ctx) }
 // }
+
+func TestStoreFormatVersion(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	store := &resultStore{db: db, keyPrefix: "torrent_", codec: msgpackCodec{}}
+	results := []imdb2torrent.Result{{InfoHash: "123", Title: "foo"}}
+
+	require.NoError(t, store.Set("tt123", results))
+	actual, _, found, err := store.Get("tt123")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, results, actual)
+
+	// A value with another format version is a cache miss, not an error
+	b, err := encode(msgpackCodec{}, imdb2torrent.CacheItem{Results: results})
+	require.NoError(t, err)
+	b[1] = formatVersion + 1
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("torrent_tt123"), b)
+	})
+	require.NoError(t, err)
+	_, _, found, err = store.Get("tt123")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestRedisCreationCache(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	availabilityCache := &creationCache{rdb: rdb, prefix: "availability-rd:", expiration: time.Minute}
+	tokenCache := &creationCache{rdb: rdb, prefix: "token:", expiration: time.Minute}
+	k := strconv.Itoa(rand.Intn(math.MaxUint32))
+
+	_, found, err := availabilityCache.Get(k)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	before := time.Now()
+	require.NoError(t, availabilityCache.Set(k))
+	created, found, err := availabilityCache.Get(k)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.False(t, created.Before(before))
+	require.False(t, created.After(time.Now()))
+
+	// The prefix separates the caches
+	_, found, err = tokenCache.Get(k)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	ttl, err := rdb.TTL(context.Background(), "availability-rd:"+k).Result()
+	require.NoError(t, err)
+	require.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// Flushing only removes the keys of the flushed cache
+	require.NoError(t, tokenCache.Set(k))
+	require.NoError(t, availabilityCache.Flush())
+	_, found, err = availabilityCache.Get(k)
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = tokenCache.Get(k)
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestLocalCreationCache(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	c := &creationCache{rdb: rdb, local: newLRUCache(10, 50*time.Millisecond, nil), prefix: "availability-rd:", expiration: time.Minute}
+	k := strconv.Itoa(rand.Intn(math.MaxUint32))
+
+	require.NoError(t, c.Set(k))
+	created, found, err := c.Get(k)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	// Writes of other instances are only visible after the local entry expired
+	later := created.Add(time.Second)
+	require.NoError(t, rdb.Set(context.Background(), "availability-rd:"+k, later.UnixNano(), time.Minute).Err())
+	actual, _, err := c.Get(k)
+	require.NoError(t, err)
+	require.True(t, actual.Equal(created))
+	time.Sleep(60 * time.Millisecond)
+	actual, _, err = c.Get(k)
+	require.NoError(t, err)
+	require.True(t, actual.Equal(later))
+
+	// Misses aren't cached locally
+	k = strconv.Itoa(rand.Intn(math.MaxUint32))
+	_, found, err = c.Get(k)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, rdb.Set(context.Background(), "availability-rd:"+k, later.UnixNano(), time.Minute).Err())
+	_, found, err = c.Get(k)
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestBadgerCreationCache(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	availabilityCache := &creationCache{db: db, prefix: "availability-rd_", expiration: time.Minute}
+	tokenCache := &creationCache{db: db, prefix: "token_", expiration: time.Minute}
+
+	_, found, err := availabilityCache.Get("123")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	before := time.Now()
+	require.NoError(t, availabilityCache.Set("123"))
+	created, found, err := availabilityCache.Get("123")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.False(t, created.Before(before))
+	require.False(t, created.After(time.Now()))
+
+	// The prefix separates the caches
+	_, found, err = tokenCache.Get("123")
+	require.NoError(t, err)
+	require.False(t, found)
+	// Flushing only removes the keys of the flushed cache
+	require.NoError(t, tokenCache.Set("123"))
+	require.NoError(t, availabilityCache.Flush())
+	_, found, err = availabilityCache.Get("123")
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = tokenCache.Get("123")
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestCreationCacheStats(t *testing.T) {
+	c := &creationCache{
+		cache:      gocache.New(time.Hour, time.Hour),
+		expiration: time.Hour,
+	}
+	_, _, _ = c.Get("123")
+	require.NoError(t, c.Set("123"))
+	_, _, _ = c.Get("123")
+	// Expired, but not removed by the janitor yet
+	c.cache.Set("456", time.Now().Add(-2*time.Hour), 0)
+	_, _, _ = c.Get("456")
+	require.Equal(t, cacheStats{Hits: 1, Misses: 1, Expired: 1}, c.Stats())
+}
+
+func TestCreationCacheHashedKeys(t *testing.T) {
+	c := &creationCache{
+		cache:      gocache.New(time.Hour, time.Hour),
+		expiration: time.Hour,
+		hashKeys:   true,
+	}
+	require.NoError(t, c.Set("secret-token"))
+	_, found, err := c.Get("secret-token")
+	require.NoError(t, err)
+	require.True(t, found)
+	items := c.cache.Items()
+	require.Len(t, items, 1)
+	require.NotContains(t, items, "secret-token")
+	require.Contains(t, items, hashKey("secret-token"))
+
+	// Persisted items with plain keys are migrated, already hashed ones are kept
+	items["other-token"] = gocache.Item{Object: time.Now()}
+	migrated := withHashedKeys(items)
+	require.Len(t, migrated, 2)
+	require.Contains(t, migrated, hashKey("secret-token"))
+	require.Contains(t, migrated, hashKey("other-token"))
+}
+
+func TestCreationCacheJitter(t *testing.T) {
+	c := &creationCache{
+		cache:      gocache.New(time.Hour, time.Hour),
+		expiration: time.Hour,
+		jitter:     0.1,
+	}
+	before := time.Now()
+	var createdTimes []time.Time
+	for i := 0; i < 10; i++ {
+		k := strconv.Itoa(i)
+		require.NoError(t, c.Set(k))
+		created, found, err := c.Get(k)
+		require.NoError(t, err)
+		require.True(t, found)
+		createdTimes = append(createdTimes, created)
+	}
+	// Entries that are written at the same time expire at different times, but at most 10% (6 minutes) earlier
+	differs := false
+	for _, created := range createdTimes {
+		require.False(t, created.Before(before.Add(-6*time.Minute)))
+		require.False(t, created.After(time.Now()))
+		if !created.Equal(createdTimes[0]) {
+			differs = true
+		}
+	}
+	require.True(t, differs)
+}
@@ -10,7 +10,30 @@ import (
 	"go.uber.org/zap"
 )
 
+// userDataVersion is the current version of the user data schema.
+// When changing the schema in a way that's incompatible with older user data (renaming, moving or removing fields, changing their meaning),
+// increment this and append a migration to userDataMigrations.
+// Users must never have to reinstall the addon because of such a change, so old data must always be upgradeable.
+const userDataVersion = 1
+
+// userDataMigration upgrades raw user data from one schema version to the next one.
+// It returns the names of deprecated fields or formats it encountered, which are logged by the caller.
+type userDataMigration func(raw map[string]interface{}) (deprecated []string, err error)
+
+// userDataMigrations contains the user data migrations. The migration at index i upgrades from version i to i+1.
+// So the length of the slice must always be the same as userDataVersion.
+var userDataMigrations = []userDataMigration{
+	// v0 -> v1: Legacy user data, which was a plain RealDebrid API token, optionally with a "-remote" suffix.
+	// The token is already put into the raw map when detecting the legacy format, as it's not JSON.
+	func(raw map[string]interface{}) ([]string, error) {
+		return []string{"plain RealDebrid API token"}, nil
+	},
+}
+
 type userData struct {
+	// Schema version, see userDataVersion.
+	// JSON user data without this field is version 1, because the first JSON format was introduced with version 1.
+	Version int `json:"v,omitempty"`
 	// RealDebrid
 	RDtoken  string `json:"rdToken,omitempty"`
 	RDoauth2 string `json:"rdOAUTH2,omitempty"`
@@ -20,10 +43,24 @@ type userData struct {
 	// Premiumize
 	PMkey    string `json:"pmKey,omitempty"`
 	PMoauth2 string `json:"pmOAUTH2,omitempty"`
+	// Manifest customization
+	LogoURL string `json:"logoURL,omitempty"`
+}
+
+// debridID returns the short ID of the debrid service the user configured, which is "rd", "ad" or "pm".
+// We expect a user to have *either* RealDebrid *or* AllDebrid *or* Premiumize data, see the auth middleware.
+func (ud userData) debridID() string {
+	if ud.RDtoken != "" || ud.RDoauth2 != "" {
+		return "rd"
+	} else if ud.ADkey != "" {
+		return "ad"
+	}
+	return "pm"
 }
 
 func (ud userData) encode(logger *zap.Logger) (string, error) {
 	logger.Debug("Encoding user data")
+	ud.Version = userDataVersion
 	userDataJSON, err := json.Marshal(ud)
 	if err != nil {
 		return "", err
@@ -35,6 +72,9 @@ func (ud userData) encode(logger *zap.Logger) (string, error) {
 func decodeUserData(data string, logger *zap.Logger) (userData, error) {
 	logger.Debug("Decoding user data", zap.String("userData", data))
 
+	raw := map[string]interface{}{}
+	version := 1
+
 	// Legacy user data (plain string, RD only).
 	// - If it's ending with "-remote" it's 100% clear
 	// - RD API tokens always seem to be 52 chars long
@@ -44,34 +84,73 @@ func decodeUserData(data string, logger *zap.Logger) (userData, error) {
 		if len(tokenParts) > 2 {
 			return userData{}, errors.New("legacy userData was not correctly formatted")
 		}
-		logger.Info("A legacy API token is being used", zap.Bool("remote", true))
-		return userData{
-			RDtoken:  tokenParts[0],
-			RDremote: true,
-		}, nil
+		raw["rdToken"] = tokenParts[0]
+		raw["rdRemote"] = true
+		version = 0
 	} else if len(data) == 52 && !strings.HasPrefix(data, "eyJ") && !strings.HasPrefix(data, "eyI") {
-		logger.Info("A legacy API token is being used", zap.Bool("remote", false))
-		return userData{
-			RDtoken:  data,
-			RDremote: false,
-		}, nil
+		raw["rdToken"] = data
+		version = 0
+	} else {
+		// If there's padding, we remove it, so that the decoding works with both:
+		data = strings.TrimSuffix(data, "=")
+		userDataDecoded, err := base64.RawURLEncoding.DecodeString(data)
+		if err != nil {
+			// We use WARN instead of ERROR because it's most likely an *encoding* error on the client side
+			logger.Warn("Couldn't decode user data", zap.Error(err))
+			return userData{}, err
+		}
+		if err := json.Unmarshal(userDataDecoded, &raw); err != nil {
+			logger.Warn("Couldn't unmarshal user data", zap.Error(err))
+			return userData{}, err
+		}
+		if v, ok := raw["v"]; ok {
+			// JSON numbers are unmarshalled into float64 when the target is an interface{}
+			vFloat, ok := v.(float64)
+			if !ok || vFloat != float64(int(vFloat)) {
+				logger.Warn("User data contains invalid version", zap.String("version", fmt.Sprintf("%v", v)))
+				return userData{}, errors.New("invalid user data version")
+			}
+			version = int(vFloat)
+		}
 	}
 
-	// If there's padding, we remove it, so that the decoding works with both:
-	data = strings.TrimSuffix(data, "=")
-	var userDataDecoded []byte
-	userDataDecoded, err := base64.RawURLEncoding.DecodeString(data)
+	ud, err := migrateUserData(raw, version, logger)
 	if err != nil {
-		// We use WARN instead of ERROR because it's most likely an *encoding* error on the client side
-		logger.Warn("Couldn't decode user data", zap.Error(err))
 		return userData{}, err
 	}
+	logger.Debug("Decoded user data", zap.String("userData", fmt.Sprintf("%+v", ud)))
+	return ud, nil
+}
 
+// migrateUserData upgrades the raw user data from the given version to the current one and converts it into a userData object.
+// This happens on each request, so the user data in the URLs of existing installations keeps working.
+func migrateUserData(raw map[string]interface{}, version int, logger *zap.Logger) (userData, error) {
+	if version < 0 || version > userDataVersion {
+		logger.Warn("User data has an unknown version", zap.Int("version", version))
+		return userData{}, fmt.Errorf("unknown user data version: %v", version)
+	}
+	for i := version; i < userDataVersion; i++ {
+		deprecated, err := userDataMigrations[i](raw)
+		if err != nil {
+			logger.Warn("Couldn't migrate user data", zap.Error(err), zap.Int("fromVersion", i))
+			return userData{}, err
+		}
+		if len(deprecated) > 0 {
+			logger.Info("User data with deprecated fields or formats is being used", zap.Int("fromVersion", i), zap.Strings("deprecated", deprecated))
+		}
+	}
+	raw["v"] = userDataVersion
+
+	// Convert the generic map into the actual struct by going through JSON again.
+	// User data is small, so this doesn't matter performance-wise.
+	rawJSON, err := json.Marshal(raw)
+	if err != nil {
+		return userData{}, err
+	}
 	ud := userData{}
-	if err := json.Unmarshal(userDataDecoded, &ud); err != nil {
-		logger.Warn("Couldn't unmarshal user data", zap.Error(err))
+	if err = json.Unmarshal(rawJSON, &ud); err != nil {
+		logger.Warn("Couldn't unmarshal migrated user data", zap.Error(err))
 		return userData{}, err
 	}
-	logger.Debug("Decoded user data", zap.String("userData", fmt.Sprintf("%+v", ud)))
 	return ud, nil
 }
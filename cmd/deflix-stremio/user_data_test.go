@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDecodeUserData(t *testing.T) {
+	// RD API tokens are 52 characters long
+	legacyToken := "ABCDEFGHIJKLMNOPQRSTUVWXYZABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	tests := []struct {
+		name     string
+		data     string
+		expected userData
+		wantErr  bool
+	}{
+		{
+			name:     "legacy token",
+			data:     legacyToken,
+			expected: userData{Version: userDataVersion, RDtoken: legacyToken},
+		},
+		{
+			name:     "legacy token with remote suffix",
+			data:     legacyToken + "-remote",
+			expected: userData{Version: userDataVersion, RDtoken: legacyToken, RDremote: true},
+		},
+		{
+			name:     "JSON without version",
+			data:     base64.RawURLEncoding.EncodeToString([]byte(`{"adKey":"foo"}`)),
+			expected: userData{Version: userDataVersion, ADkey: "foo"},
+		},
+		{
+			name:     "JSON with version and padding",
+			data:     base64.URLEncoding.EncodeToString([]byte(`{"v":1,"pmKey":"foo"}`)),
+			expected: userData{Version: userDataVersion, PMkey: "foo"},
+		},
+		{
+			name:    "JSON with unknown version",
+			data:    base64.RawURLEncoding.EncodeToString([]byte(`{"v":99,"pmKey":"foo"}`)),
+			wantErr: true,
+		},
+		{
+			name:    "JSON with invalid version",
+			data:    base64.RawURLEncoding.EncodeToString([]byte(`{"v":"1","pmKey":"foo"}`)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := decodeUserData(tt.data, zap.NewNop())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestUserDataMigrationsLength(t *testing.T) {
+	require.Len(t, userDataMigrations, userDataVersion)
+}
+
+func TestUserDataRoundTrip(t *testing.T) {
+	logger := zap.NewNop()
+	ud := userData{RDtoken: "foo", RDremote: true}
+	encoded, err := ud.encode(logger)
+	require.NoError(t, err)
+	actual, err := decodeUserData(encoded, logger)
+	require.NoError(t, err)
+	ud.Version = userDataVersion
+	require.Equal(t, ud, actual)
+}
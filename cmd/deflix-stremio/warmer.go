@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/go-debrid"
+)
+
+// availabilityWarmer keeps the instant availability of frequently requested torrents in the availability caches,
+// so that stream requests for popular movies and TV shows don't have to wait for the debrid service.
+// The debrid clients only send requests for info hashes whose cache entries are missing or expired,
+// so the warmer refreshes the hot info hashes when their cache entries expire within the next interval, which keeps them cached.
+type availabilityWarmer struct {
+	providers map[string]debridProvider
+	// The availability caches that the debrid clients use
+	caches   map[string]*refreshableCache
+	cacheAge time.Duration
+	interval time.Duration
+	// Max number of info hashes per debrid service that are checked per run
+	maxHashes int
+	// Debrid service ID -> info hash -> number of stream requests in which it was available.
+	// Halved after each run, so that titles that aren't popular anymore drop out.
+	counts map[string]map[string]int
+	// Debrid service ID -> API key or token of a service account.
+	// Instant availability is the same for all users of a debrid service, but the API requires authentication.
+	// The keys and tokens of users aren't used, because users didn't agree to requests on their behalf outside of their own stream requests.
+	// Only the debrid services in this map are warmed.
+	keyOrTokens map[string]string
+	lock        *sync.Mutex
+	logger      *zap.Logger
+}
+
+func newAvailabilityWarmer(providers map[string]debridProvider, caches map[string]*refreshableCache, keyOrTokens map[string]string, cacheAge, interval time.Duration, maxHashes int, logger *zap.Logger) *availabilityWarmer {
+	return &availabilityWarmer{
+		providers:   providers,
+		caches:      caches,
+		cacheAge:    cacheAge,
+		interval:    interval,
+		maxHashes:   maxHashes,
+		counts:      map[string]map[string]int{},
+		keyOrTokens: keyOrTokens,
+		lock:        &sync.Mutex{},
+		logger:      logger,
+	}
+}
+
+// track counts the info hashes that were available in a stream request.
+// It's a no-op for a nil warmer, so the stream handler doesn't need to check if warming is enabled.
+func (w *availabilityWarmer) track(debridID string, infoHashes []string) {
+	if w == nil {
+		return
+	}
+	if _, ok := w.keyOrTokens[debridID]; !ok {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.counts[debridID]; !ok {
+		w.counts[debridID] = map[string]int{}
+	}
+	for _, infoHash := range infoHashes {
+		w.counts[debridID][infoHash]++
+	}
+}
+
+// run warms the caches in the configured interval until the context is canceled.
+func (w *availabilityWarmer) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for debridID := range w.keyOrTokens {
+				w.warm(ctx, debridID, w.providers[debridID])
+			}
+		}
+	}
+}
+
+func (w *availabilityWarmer) warm(ctx context.Context, debridID string, provider debridProvider) {
+	infoHashes := w.hotInfoHashes(debridID)
+	var expired []string
+	for _, infoHash := range infoHashes {
+		// Errors are treated as cache misses.
+		// Entries that expire before the next run are checked as well, otherwise they'd be missing until then.
+		created, found, err := w.caches[debridID].Cache.Get(infoHash)
+		if err != nil || !found || time.Since(created) > w.cacheAge-w.interval {
+			expired = append(expired, infoHash)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	// Without the refresh the debrid client would answer the entries that didn't expire yet from the cache, without a request
+	var available []string
+	w.caches[debridID].refresh(expired, func() {
+		available = checkInstantAvailability(ctx, provider, nil, 0, w.keyOrTokens[debridID], 0, 1, expired...).available
+	})
+	w.logger.Debug("Warmed availability cache", zap.String("debridService", debridID), zap.Int("checked", len(expired)), zap.Int("available", len(available)))
+}
+
+// hotInfoHashes returns the most frequently available info hashes of the debrid service.
+func (w *availabilityWarmer) hotInfoHashes(debridID string) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	counts := w.counts[debridID]
+	infoHashes := make([]string, 0, len(counts))
+	for infoHash := range counts {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Slice(infoHashes, func(i, j int) bool {
+		return counts[infoHashes[i]] > counts[infoHashes[j]]
+	})
+	if len(infoHashes) > w.maxHashes {
+		infoHashes = infoHashes[:w.maxHashes]
+	}
+	for infoHash, count := range counts {
+		if count/2 == 0 {
+			delete(counts, infoHash)
+		} else {
+			counts[infoHash] = count / 2
+		}
+	}
+	return infoHashes
+}
+
+var _ debrid.Cache = (*refreshableCache)(nil)
+
+// refreshableCache wraps the availability cache of a debrid client.
+// It reports the keys that are being refreshed as missing, so that the client sends a request for them and caches the result again.
+// When the request fails, the existing entries stay as they are.
+type refreshableCache struct {
+	debrid.Cache
+	refreshing map[string]struct{}
+	lock       *sync.RWMutex
+}
+
+func newRefreshableCache(cache debrid.Cache) *refreshableCache {
+	return &refreshableCache{
+		Cache:      cache,
+		refreshing: map[string]struct{}{},
+		lock:       &sync.RWMutex{},
+	}
+}
+
+func (c *refreshableCache) Get(key string) (time.Time, bool, error) {
+	c.lock.RLock()
+	_, ok := c.refreshing[key]
+	c.lock.RUnlock()
+	if ok {
+		return time.Time{}, false, nil
+	}
+	return c.Cache.Get(key)
+}
+
+// refresh makes Get report the keys as missing while f runs.
+func (c *refreshableCache) refresh(keys []string, f func()) {
+	c.lock.Lock()
+	for _, key := range keys {
+		c.refreshing[key] = struct{}{}
+	}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		for _, key := range keys {
+			delete(c.refreshing, key)
+		}
+		c.lock.Unlock()
+	}()
+	f()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/go-debrid"
+)
+
+func TestAvailabilityWarmer(t *testing.T) {
+	cache := newRefreshableCache(debrid.NewInMemoryCache())
+	// Like the debrid clients, the provider skips cached info hashes
+	p := &fakeProvider{cache: cache, cacheAge: time.Hour}
+	w := newAvailabilityWarmer(map[string]debridProvider{"rd": p}, map[string]*refreshableCache{"rd": cache}, map[string]string{"rd": "123"}, time.Hour, time.Minute, 2, zap.NewNop())
+
+	// A nil warmer must be usable
+	var nilWarmer *availabilityWarmer
+	nilWarmer.track("rd", []string{"A1"})
+
+	w.track("rd", []string{"A1", "A2", "A3"})
+	w.track("rd", []string{"A2", "A3"})
+	w.track("rd", []string{"A3"})
+	// No service token for AD, so it's not tracked
+	w.track("ad", []string{"A1"})
+	require.NotContains(t, w.counts, "ad")
+	// Still cached, so it's not checked again
+	require.NoError(t, cache.Set("A3"))
+
+	w.warm(context.Background(), "rd", p)
+	// Only the 2 hottest ones are considered
+	require.Equal(t, [][]string{{"A2"}}, p.batches)
+
+	// Counts are halved after each run, so A1 dropped out, and after another run all of them
+	require.ElementsMatch(t, []string{"A2", "A3"}, w.hotInfoHashes("rd"))
+	require.Empty(t, w.hotInfoHashes("rd"))
+}
+
+func TestAvailabilityWarmerExpiresSoon(t *testing.T) {
+	cache := newRefreshableCache(debrid.NewInMemoryCache())
+	p := &fakeProvider{cache: cache, cacheAge: time.Hour}
+	// The entry is still valid, but it expires within the next interval, so it's refreshed already
+	w := newAvailabilityWarmer(map[string]debridProvider{"rd": p}, map[string]*refreshableCache{"rd": cache}, map[string]string{"rd": "123"}, time.Hour, time.Hour, 2, zap.NewNop())
+	require.NoError(t, cache.Set("A1"))
+	created, _, _ := cache.Get("A1")
+	time.Sleep(time.Millisecond)
+	w.track("rd", []string{"A1"})
+
+	w.warm(context.Background(), "rd", p)
+	require.Equal(t, [][]string{{"A1"}}, p.batches)
+	refreshed, found, err := cache.Get("A1")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.True(t, refreshed.After(created))
+
+	// A failed request keeps the existing entry
+	p.fail = true
+	w.track("rd", []string{"A1"})
+	w.warm(context.Background(), "rd", p)
+	require.Len(t, p.batches, 2)
+	created, found, err = cache.Get("A1")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, refreshed, created)
+}
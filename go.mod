@@ -3,6 +3,8 @@ module github.com/doingodswork/deflix-stremio
 go 1.15
 
 require (
+	github.com/VictoriaMetrics/metrics v1.12.3
+	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/deflix-tv/go-debrid v0.1.0
 	github.com/deflix-tv/go-stremio v0.9.2-0.20210202204625-e3e7a578d4d7
 	github.com/deflix-tv/imdb2meta v0.2.1
@@ -11,12 +13,17 @@ require (
 	github.com/go-redis/redis/v8 v8.4.10
 	github.com/gofiber/fiber/v2 v2.3.3
 	github.com/google/go-cmp v0.5.4
+	github.com/klauspost/compress v1.11.0
 	github.com/markbates/pkger v0.17.1
+	github.com/nats-io/nats.go v1.10.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/segmentio/kafka-go v0.4.10
 	github.com/spf13/afero v1.5.1
 	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.1.0
 	go.uber.org/multierr v1.6.0
 	go.uber.org/zap v1.16.0
 	golang.org/x/oauth2 v0.0.0-20210113205817-d3ed898aa8a3
+	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
 	google.golang.org/grpc v1.35.0
 )
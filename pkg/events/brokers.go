@@ -0,0 +1,110 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+var _ Sink = (*NATSsink)(nil)
+
+// NATSsink publishes each event as JSON to a NATS subject.
+type NATSsink struct {
+	conn    *nats.Conn
+	subject string
+	logger  *zap.Logger
+}
+
+// NewNATSsink connects to the NATS server(s) and creates a new NATSsink.
+// The url can contain multiple comma-separated server URLs.
+// The connection is closed when the bus the sink subscribed to is closed.
+func NewNATSsink(url, subject string, timeout time.Duration, logger *zap.Logger) (*NATSsink, error) {
+	conn, err := nats.Connect(url, nats.Name("deflix-stremio"), nats.Timeout(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSsink{
+		conn:    conn,
+		subject: subject,
+		logger:  logger,
+	}, nil
+}
+
+// Handle implements the Sink interface.
+func (s *NATSsink) Handle(e Event) {
+	eJSON, err := json.Marshal(e)
+	if err != nil {
+		s.logger.Error("Couldn't marshal event into JSON", zap.Error(err))
+		return
+	}
+	// The NATS client buffers and reconnects on its own, so this doesn't block on network I/O.
+	if err = s.conn.Publish(s.subject, eJSON); err != nil {
+		s.logger.Warn("Couldn't publish event to NATS", zap.Error(err), zap.String("subject", s.subject))
+	}
+}
+
+// Close flushes buffered events and closes the connection.
+func (s *NATSsink) Close() error {
+	defer s.conn.Close()
+	return s.conn.FlushTimeout(5 * time.Second)
+}
+
+var _ Sink = (*KafkaSink)(nil)
+
+// KafkaSink produces each event as JSON message to a Kafka topic.
+// The message key is the event type, so all events of the same type end up in the same partition in order.
+type KafkaSink struct {
+	writer *kafka.Writer
+	logger *zap.Logger
+}
+
+// NewKafkaSink creates a new KafkaSink.
+// Messages are written asynchronously in batches, so errors are only logged.
+// Buffered messages are written when the bus the sink subscribed to is closed.
+func NewKafkaSink(brokers []string, topic string, timeout time.Duration, logger *zap.Logger) *KafkaSink {
+	s := &KafkaSink{
+		logger: logger,
+	}
+	s.writer = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: time.Second,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				s.logger.Warn("Couldn't write events to Kafka", zap.Error(err), zap.String("topic", topic), zap.Int("messageCount", len(messages)))
+			}
+		},
+	}
+	return s
+}
+
+// Handle implements the Sink interface.
+func (s *KafkaSink) Handle(e Event) {
+	eJSON, err := json.Marshal(e)
+	if err != nil {
+		s.logger.Error("Couldn't marshal event into JSON", zap.Error(err))
+		return
+	}
+	msg := kafka.Message{
+		Key:   []byte(e.Type),
+		Value: eJSON,
+		Time:  e.Time,
+	}
+	// With Async being true this only enqueues the message.
+	if err = s.writer.WriteMessages(context.Background(), msg); err != nil {
+		s.logger.Warn("Couldn't enqueue event for Kafka", zap.Error(err))
+	}
+}
+
+// Close writes buffered messages and closes the writer.
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// Type is the type of an event.
+type Type string
+
+const (
+	// ResolutionStarted is published when the redirect handler starts converting torrents into a stream URL.
+	ResolutionStarted Type = "resolution_started"
+	// ResolutionSucceeded is published when one of the torrents was converted into a stream URL.
+	ResolutionSucceeded Type = "resolution_succeeded"
+	// ResolutionFailed is published when none of the torrents could be converted into a stream URL.
+	ResolutionFailed Type = "resolution_failed"
+	// StreamCacheHit is published when the redirect handler found a converted stream URL in the stream cache.
+	StreamCacheHit Type = "stream_cache_hit"
+	// StreamCacheMiss is published when the redirect handler didn't find a converted stream URL in the stream cache.
+	StreamCacheMiss Type = "stream_cache_miss"
+	// ProviderError is published when a debrid service returned an error for a single torrent.
+	ProviderError Type = "provider_error"
+	// ProviderMaintenance is published when a debrid service seems to be under maintenance and no further requests are sent to it for a while.
+	ProviderMaintenance Type = "provider_maintenance"
+	// ScraperDisabled is published when a torrent site is temporarily not searched anymore because of repeated failures.
+	ScraperDisabled Type = "scraper_disabled"
+	// ScraperRecovered is published when a search on a previously disabled torrent site succeeded again.
+	ScraperRecovered Type = "scraper_recovered"
+)
+
+// Event is something that happened in the addon that integrations might be interested in.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	// Debrid service, like "rd", "ad" or "pm". Empty if not applicable.
+	Provider string `json:"provider,omitempty"`
+	// Torrent site, like "YTS" or "RARBG". Empty if not applicable.
+	Scraper string `json:"scraper,omitempty"`
+	// Redirect ID, like "tt1254207-rd-720p". Empty if not applicable.
+	RedirectID string `json:"redirectID,omitempty"`
+	// Error message, only set for failure events.
+	Error string `json:"error,omitempty"`
+	// Only set for events that mark the end of something, like ResolutionSucceeded.
+	// For ScraperDisabled and ProviderMaintenance it's the duration until the next request is sent.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Sink receives all events that are published on the bus it subscribed to.
+// Handle is called from a single goroutine, so a slow sink delays all other sinks.
+// Implementations that do I/O should use a timeout.
+type Sink interface {
+	Handle(Event)
+}
+
+// SinkFunc is an adapter to allow the use of ordinary functions as sinks.
+type SinkFunc func(Event)
+
+// Handle implements the Sink interface.
+func (f SinkFunc) Handle(e Event) {
+	f(e)
+}
+
+// Bus distributes published events to all subscribed sinks.
+// Publishing never blocks. If the buffer is full, the event is dropped.
+type Bus struct {
+	queue  chan Event
+	done   chan struct{}
+	sinks  []Sink
+	lock   *sync.RWMutex
+	logger *zap.Logger
+}
+
+// NewBus creates a new Bus and starts the goroutine that distributes the events to the sinks.
+// You should call Close() when finished.
+func NewBus(bufferSize int, logger *zap.Logger) *Bus {
+	b := &Bus{
+		queue:  make(chan Event, bufferSize),
+		done:   make(chan struct{}),
+		lock:   &sync.RWMutex{},
+		logger: logger,
+	}
+	go b.run()
+	return b
+}
+
+// Subscribe adds a sink to the bus. It only receives events that are published after subscribing.
+func (b *Bus) Subscribe(sink Sink) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+// Publish puts an event on the bus. If the event's time is zero, it's set to the current time.
+// It's safe to call Publish on a nil Bus, which is a no-op.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case b.queue <- e:
+	default:
+		b.logger.Warn("Event bus buffer is full, dropping event", zap.String("eventType", string(e.Type)))
+	}
+}
+
+// Close stops the bus after all already published events are handled.
+// Afterwards it closes all sinks that implement io.Closer, like the ones that hold a connection to a message broker.
+// Publishing after closing leads to a panic.
+func (b *Bus) Close() error {
+	close(b.queue)
+	<-b.done
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var result error
+	for _, sink := range b.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				result = multierr.Append(result, err)
+			}
+		}
+	}
+	return result
+}
+
+func (b *Bus) run() {
+	for e := range b.queue {
+		b.lock.RLock()
+		for _, sink := range b.sinks {
+			sink.Handle(e)
+		}
+		b.lock.RUnlock()
+	}
+	close(b.done)
+}
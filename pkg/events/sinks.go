@@ -0,0 +1,116 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+)
+
+var _ Sink = (*LogSink)(nil)
+
+// LogSink logs each event with DEBUG level, or WARN level for failure events.
+type LogSink struct {
+	logger *zap.Logger
+}
+
+// NewLogSink creates a new LogSink.
+func NewLogSink(logger *zap.Logger) *LogSink {
+	return &LogSink{
+		logger: logger,
+	}
+}
+
+// Handle implements the Sink interface.
+func (s *LogSink) Handle(e Event) {
+	fields := []zap.Field{
+		zap.String("eventType", string(e.Type)),
+		zap.Time("eventTime", e.Time),
+	}
+	if e.Provider != "" {
+		fields = append(fields, zap.String("provider", e.Provider))
+	}
+	if e.Scraper != "" {
+		fields = append(fields, zap.String("scraper", e.Scraper))
+	}
+	if e.RedirectID != "" {
+		fields = append(fields, zap.String("redirectID", e.RedirectID))
+	}
+	if e.Duration != 0 {
+		fields = append(fields, zap.Duration("duration", e.Duration))
+	}
+	if e.Error != "" {
+		fields = append(fields, zap.String("error", e.Error))
+		s.logger.Warn("Event", fields...)
+	} else {
+		s.logger.Debug("Event", fields...)
+	}
+}
+
+var _ Sink = (*MetricsSink)(nil)
+
+// MetricsSink counts events by type and provider via the VictoriaMetrics default set,
+// which is what go-stremio exposes at "/metrics" when metrics are enabled.
+// The cache hit ratio can be calculated from the "stream_cache_hit" and "stream_cache_miss" counters.
+type MetricsSink struct{}
+
+// NewMetricsSink creates a new MetricsSink.
+func NewMetricsSink() *MetricsSink {
+	return &MetricsSink{}
+}
+
+// Handle implements the Sink interface.
+func (s *MetricsSink) Handle(e Event) {
+	// With the VictoriaMetrics client library we have to use this workaround for having an equivalent of Prometheus' CounterVec,
+	// see https://pkg.go.dev/github.com/VictoriaMetrics/metrics@v1.12.3#example-Counter-Vec.
+	counterName := fmt.Sprintf(`deflix_events_total{type="%v", provider="%v"}`, e.Type, e.Provider)
+	metrics.GetOrCreateCounter(counterName).Inc()
+	if e.Type == ResolutionSucceeded || e.Type == ResolutionFailed {
+		summaryName := fmt.Sprintf(`deflix_resolution_duration_seconds{provider="%v"}`, e.Provider)
+		metrics.GetOrCreateSummary(summaryName).Update(e.Duration.Seconds())
+	}
+}
+
+var _ Sink = (*WebhookSink)(nil)
+
+// WebhookSink sends each event as JSON in the body of a POST request to a URL.
+type WebhookSink struct {
+	url        string
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+// NewWebhookSink creates a new WebhookSink.
+func NewWebhookSink(url string, timeout time.Duration, logger *zap.Logger) *WebhookSink {
+	return &WebhookSink{
+		url: url,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		logger: logger,
+	}
+}
+
+// Handle implements the Sink interface.
+func (s *WebhookSink) Handle(e Event) {
+	eJSON, err := json.Marshal(e)
+	if err != nil {
+		s.logger.Error("Couldn't marshal event into JSON", zap.Error(err))
+		return
+	}
+	res, err := s.httpClient.Post(s.url, "application/json", bytes.NewReader(eJSON))
+	if err != nil {
+		s.logger.Warn("Couldn't send event to webhook", zap.Error(err), zap.String("url", s.url))
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		s.logger.Warn("Bad HTTP response status from webhook", zap.Int("status", res.StatusCode), zap.ByteString("body", resBody), zap.String("url", s.url))
+	}
+}